@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchSession delivers a series of messages over one SMTP session. The
+// connection is opened on the first message, reopened transparently if the
+// server drops it, and recycled after --max-per-connection messages.
+type batchSession struct {
+	config  *Config
+	limiter *rateLimiter
+	client  *SMTPClient
+	sent    int
+}
+
+// Send delivers msg. A transaction rejected by the server, or a message
+// that cannot be sent, is reset so the session can carry on with the next
+// message. If the connection is lost, the message is retried once on a new
+// connection.
+func (b *batchSession) Send(msg *outgoingMessage) error {
+	for attempt := 0; ; attempt++ {
+		if b.client != nil && b.config.MaxPerConnection > 0 && b.sent >= b.config.MaxPerConnection {
+			b.Close()
+		}
+		if b.client == nil {
+			client, err := openSession(b.config)
+			if err != nil {
+				return err
+			}
+			b.client = client
+			b.sent = 0
+		}
+
+		b.limiter.Wait()
+		b.sent++
+		err := b.client.Send(msg)
+		if err == nil {
+			return nil
+		}
+		if !isNetworkError(err) {
+			// A rejected transaction or a message that cannot be sent,
+			// such as one without recipients
+			if err := b.client.Reset(); err != nil {
+				b.drop()
+			}
+			return err
+		}
+
+		b.drop()
+		if attempt > 0 {
+			return err
+		}
+		if b.config.Verbose > 0 {
+			fmt.Printf("Connection lost (%v), reconnecting\n", err)
+		}
+	}
+}
+
+// isNetworkError reports whether err means the connection was lost, as
+// opposed to a rejection or a local error. A 421 reply, with which servers
+// close idle sessions or enforce a per-connection message limit, counts as
+// a lost connection.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	var protoErr *textproto.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &protoErr) && protoErr.Code == 421
+}
+
+// drop discards a connection that can no longer be used.
+func (b *batchSession) drop() {
+	b.client.conn.Close()
+	b.client = nil
+}
+
+// Close ends the session.
+func (b *batchSession) Close() error {
+	if b.client == nil {
+		return nil
+	}
+	err := b.client.Close()
+	b.client = nil
+	return err
+}
+
+// deliverAll builds count messages with build and delivers them over up to
+// --concurrency parallel sessions, limited to --rate messages per second
+// overall. Messages are built one at a time, as composing is not safe for
+// concurrent use, and report is called exactly once per message, never
+// concurrently.
+func deliverAll(config *Config, count int, build func(i int) (*outgoingMessage, error), report func(i int, err error)) {
+	if config.PrintOnly {
+		for i := 0; i < count; i++ {
+			msg, err := build(i)
+			if err == nil {
+				fmt.Print(msg.data)
+			}
+			report(i, err)
+		}
+		return
+	}
+
+	type job struct {
+		index int
+		msg   *outgoingMessage
+	}
+	var mu sync.Mutex
+	jobs := make(chan job)
+	limiter := newRateLimiter(config.Rate)
+
+	var wg sync.WaitGroup
+	for w := 0; w < max(config.Concurrency, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := &batchSession{config: config, limiter: limiter}
+			defer session.Close()
+			for j := range jobs {
+				err := session.Send(j.msg)
+				mu.Lock()
+				report(j.index, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		msg, err := build(i)
+		if err != nil {
+			mu.Lock()
+			report(i, err)
+			mu.Unlock()
+			continue
+		}
+		jobs <- job{i, msg}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// rateLimiter is a token bucket shared by all sessions of a run. It holds
+// at most one token, so messages are spaced evenly at the configured rate.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter for rate messages per second; a rate of
+// zero means no limit.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// Wait blocks until the caller may send the next message.
+func (l *rateLimiter) Wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// runBatch sends each of messages as a complete message. Failures are
+// reported per message and do not stop the batch.
+func runBatch(config *Config, messages []batchMessage) error {
+	if err := validateAddresses(config); err != nil {
+		return err
+	}
+	if err := resolveServer(config); err != nil {
+		return err
+	}
+
+	failed := 0
+	deliverAll(config, len(messages), func(i int) (*outgoingMessage, error) {
+		c := *config
+		c.Data = messages[i].name
+		c.DataContent = messages[i].data
+		return buildMessage(&c)
+	}, func(i int, err error) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %v\n", messages[i].name, err)
+		} else if config.Verbose > 0 {
+			fmt.Printf("%s: sent\n", messages[i].name)
+		}
+	})
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages failed", failed, len(messages))
+	}
+	return nil
+}
+
+// expandDataFiles resolves the --data arguments into a list of message
+// files. Directories contribute their regular, non-hidden files and
+// arguments containing wildcards are expanded as globs, both in sorted
+// order.
+func expandDataFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if arg == "-" {
+			files = append(files, arg)
+			continue
+		}
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+			files = append(files, matches...)
+			continue
+		}
+
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		var dirFiles []string
+		for _, e := range entries {
+			if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+				dirFiles = append(dirFiles, filepath.Join(arg, e.Name()))
+			}
+		}
+		if len(dirFiles) == 0 {
+			return nil, fmt.Errorf("no message files in %s", arg)
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
@@ -0,0 +1,514 @@
+package main
+
+//go:generate sh -c "python3 tools/gencharsets.py > charset_tables.go"
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// charsetCodec converts between a charset and UTF-8, which smtp-cli uses
+// internally for composing messages.
+type charsetCodec interface {
+	decode(data string) (string, error)
+	encode(text string) (string, error)
+}
+
+// charsetAliases maps normalized charset names (lower case, without "-",
+// "_" and spaces) to the canonical name.
+var charsetAliases = map[string]string{
+	"utf8": "UTF-8", "usascii": "US-ASCII", "ascii": "US-ASCII",
+	"latin1": "ISO-8859-1", "latin2": "ISO-8859-2", "latin3": "ISO-8859-3", "latin4": "ISO-8859-4",
+	"cyrillic": "ISO-8859-5", "arabic": "ISO-8859-6", "greek": "ISO-8859-7", "hebrew": "ISO-8859-8",
+	"latin5": "ISO-8859-9", "latin6": "ISO-8859-10", "latin7": "ISO-8859-13", "latin8": "ISO-8859-14",
+	"latin9": "ISO-8859-15", "latin10": "ISO-8859-16",
+	"shiftjis": "Shift_JIS", "sjis": "Shift_JIS", "mskanji": "Shift_JIS", "xsjis": "Shift_JIS",
+	"iso2022jp": "ISO-2022-JP", "csiso2022jp": "ISO-2022-JP",
+}
+
+func init() {
+	for name := range singleByteTables {
+		charsetAliases[normalizeCharsetName(name)] = name
+		if strings.HasPrefix(name, "windows-") {
+			charsetAliases["cp"+name[len("windows-"):]] = name
+		}
+	}
+}
+
+func normalizeCharsetName(name string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(name))
+}
+
+// canonicalCharset returns the canonical name of a charset, or the
+// normalized name if it is not supported.
+func canonicalCharset(name string) string {
+	if canonical, ok := charsetAliases[normalizeCharsetName(name)]; ok {
+		return canonical
+	}
+	return normalizeCharsetName(name)
+}
+
+var (
+	codecsMu sync.Mutex
+	codecs   = map[string]charsetCodec{}
+)
+
+// lookupCharset returns the codec for a charset name.
+func lookupCharset(name string) (charsetCodec, error) {
+	canonical := canonicalCharset(name)
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c, ok := codecs[canonical]; ok {
+		return c, nil
+	}
+
+	var c charsetCodec
+	switch canonical {
+	case "UTF-8":
+		c = utf8Codec{}
+	case "US-ASCII":
+		c = newSingleByteCodec(canonical, &[128]rune{})
+	case "Shift_JIS":
+		c = shiftJISCodec{}
+	case "ISO-2022-JP":
+		c = iso2022JPCodec{}
+	default:
+		table, ok := singleByteTables[canonical]
+		if !ok {
+			return nil, fmt.Errorf("unsupported charset %q", name)
+		}
+		c = newSingleByteCodec(canonical, table)
+	}
+	codecs[canonical] = c
+	return c, nil
+}
+
+// headerWordDecoder decodes RFC 2047 encoded-words in any supported charset,
+// not just the UTF-8, ISO-8859-1 and US-ASCII that mime.WordDecoder knows.
+var headerWordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// addressParser parses address headers with headerWordDecoder.
+var addressParser = &mail.AddressParser{WordDecoder: headerWordDecoder}
+
+// charsetReader converts input in charset to UTF-8 for mime.WordDecoder.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	c, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := c.decode(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}
+
+// decodeInput converts text given on the command line or read from a body
+// file from --input-charset to UTF-8. If the input is already in the
+// --charset of the message, it is passed through unchanged.
+func decodeInput(config *Config, text string) (string, error) {
+	if config.InputCharset == "" || canonicalCharset(config.InputCharset) == canonicalCharset(config.Charset) {
+		return text, nil
+	}
+	c, err := lookupCharset(config.InputCharset)
+	if err != nil {
+		return "", err
+	}
+	return c.decode(text)
+}
+
+// encodeOutput converts UTF-8 text to the --charset of the message. Text
+// that came in in that charset is passed through unchanged.
+func encodeOutput(config *Config, text string) (string, error) {
+	if config.InputCharset == "" || canonicalCharset(config.InputCharset) == canonicalCharset(config.Charset) {
+		return text, nil
+	}
+	c, err := lookupCharset(config.Charset)
+	if err != nil {
+		return "", err
+	}
+	return c.encode(text)
+}
+
+// decodeUTF8Input converts an option from --input-charset to UTF-8 even
+// when the message uses the same charset. Addresses need it for net/mail,
+// whose display names are encoded in --charset again when the header is
+// written, and event details for iCalendar, which is always UTF-8.
+func decodeUTF8Input(config *Config, text string) (string, error) {
+	if config.InputCharset == "" || canonicalCharset(config.InputCharset) == "UTF-8" {
+		return text, nil
+	}
+	c, err := lookupCharset(config.InputCharset)
+	if err != nil {
+		return "", err
+	}
+	return c.decode(text)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// maxEncodedWordLength is the limit of RFC 2047 section 2.
+const maxEncodedWordLength = 75
+
+// encodeWords RFC 2047 encodes text, which is already in charset, as a
+// sequence of encoded-words of at most 75 characters on separate lines.
+// Words are split between characters, and for ISO-2022-JP, which uses the B
+// encoding, each word returns to ASCII at its end. Text in an unsupported
+// charset is split between bytes.
+func encodeWords(charset, text string) string {
+	needsEncoding := false
+	for i := 0; i < len(text); i++ {
+		if (text[i] < ' ' || text[i] > '~') && text[i] != '\t' {
+			needsEncoding = true
+			break
+		}
+	}
+	if !needsEncoding {
+		return text
+	}
+
+	encoding := "q"
+	if canonicalCharset(charset) == "ISO-2022-JP" {
+		encoding = "b"
+	}
+	word := func(s string) string {
+		return "=?" + charset + "?" + encoding + "?" + encodeWordText(encoding, s) + "?="
+	}
+
+	// Split into characters, each of which stays in one word
+	var chars []string
+	encode := func(s string) string { return s }
+	if c, err := lookupCharset(charset); err == nil {
+		if decoded, err := c.decode(text); err == nil {
+			for _, r := range decoded {
+				chars = append(chars, string(r))
+			}
+			encode = func(s string) string {
+				encoded, _ := c.encode(s)
+				return encoded
+			}
+		}
+	}
+	if chars == nil {
+		for i := 0; i < len(text); i++ {
+			chars = append(chars, text[i:i+1])
+		}
+	}
+
+	var words []string
+	var chunk string
+	for _, char := range chars {
+		if chunk != "" && len(word(encode(chunk+char))) > maxEncodedWordLength {
+			words = append(words, word(encode(chunk)))
+			chunk = ""
+		}
+		chunk += char
+	}
+	words = append(words, word(encode(chunk)))
+	return strings.Join(words, "\r\n ")
+}
+
+// encodeWordText applies the Q or B encoding to the text of an
+// encoded-word.
+func encodeWordText(encoding, s string) string {
+	if encoding == "b" {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ':
+			b.WriteByte('_')
+		case c > ' ' && c <= '~' && c != '=' && c != '?' && c != '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "=%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// generatedText converts UTF-8 text that smtp-cli generates, such as the
+// description of an invitation, to the form decodeInput gives input in, so
+// that encodeOutput turns both into --charset.
+func generatedText(config *Config, text string) (string, error) {
+	if config.InputCharset == "" || canonicalCharset(config.InputCharset) != canonicalCharset(config.Charset) {
+		return text, nil
+	}
+	c, err := lookupCharset(config.Charset)
+	if err != nil {
+		return "", err
+	}
+	return c.encode(text)
+}
+
+// lineOf returns the 1-based line number of offset i in s, for error
+// messages.
+func lineOf(s string, i int) int {
+	return strings.Count(s[:i], "\n") + 1
+}
+
+func unrepresentable(text string, i int, r rune, charset string) error {
+	return fmt.Errorf("character %q (U+%04X) on line %d cannot be represented in %s", r, r, lineOf(text, i), charset)
+}
+
+func invalidInput(data string, i int, charset string) error {
+	return fmt.Errorf("invalid %s input on line %d", charset, lineOf(data, i))
+}
+
+type utf8Codec struct{}
+
+func (utf8Codec) decode(data string) (string, error) {
+	for i, r := range data {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(data[i:]); size == 1 {
+				return "", invalidInput(data, i, "UTF-8")
+			}
+		}
+	}
+	return data, nil
+}
+
+func (utf8Codec) encode(text string) (string, error) {
+	return text, nil
+}
+
+// singleByteCodec handles charsets that extend ASCII with 128 characters.
+type singleByteCodec struct {
+	name    string
+	table   *[128]rune
+	reverse map[rune]byte
+}
+
+func newSingleByteCodec(name string, table *[128]rune) *singleByteCodec {
+	c := &singleByteCodec{name: name, table: table, reverse: map[rune]byte{}}
+	for i, r := range table {
+		if r != 0 {
+			c.reverse[r] = byte(0x80 + i)
+		}
+	}
+	return c
+}
+
+func (c *singleByteCodec) decode(data string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] < 0x80 {
+			b.WriteByte(data[i])
+			continue
+		}
+		r := c.table[data[i]-0x80]
+		if r == 0 {
+			return "", invalidInput(data, i, c.name)
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+func (c *singleByteCodec) encode(text string) (string, error) {
+	var b strings.Builder
+	for i, r := range text {
+		if r < 0x80 {
+			b.WriteByte(byte(r))
+			continue
+		}
+		v, ok := c.reverse[r]
+		if !ok {
+			return "", unrepresentable(text, i, r, c.name)
+		}
+		b.WriteByte(v)
+	}
+	return b.String(), nil
+}
+
+var (
+	jis0208Once    sync.Once
+	jis0208Reverse map[rune]int
+)
+
+// jis0208Code returns the JIS X 0208 row and cell of r.
+func jis0208Code(r rune) (row, cell int, ok bool) {
+	jis0208Once.Do(func() {
+		jis0208Reverse = make(map[rune]int, len(jis0208))
+		for i, v := range jis0208 {
+			if _, dup := jis0208Reverse[rune(v)]; v != 0 && !dup {
+				jis0208Reverse[rune(v)] = i
+			}
+		}
+	})
+	i, ok := jis0208Reverse[r]
+	return i/94 + 1, i%94 + 1, ok
+}
+
+// jis0208Rune returns the character at a JIS X 0208 row and cell, or 0.
+func jis0208Rune(row, cell int) rune {
+	if row < 1 || row > 94 || cell < 1 || cell > 94 {
+		return 0
+	}
+	return rune(jis0208[(row-1)*94+cell-1])
+}
+
+// shiftJISCodec handles Shift_JIS: ASCII, half-width katakana and JIS X
+// 0208 in two-byte form.
+type shiftJISCodec struct{}
+
+func (shiftJISCodec) decode(data string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c >= 0xA1 && c <= 0xDF:
+			b.WriteRune(0xFF61 + rune(c-0xA1))
+		case (c >= 0x81 && c <= 0x9F || c >= 0xE0 && c <= 0xEF) && i+1 < len(data):
+			t := data[i+1]
+			row := int(c-0x81)*2 + 1
+			if c >= 0xE0 {
+				row = int(c-0xC1)*2 + 1
+			}
+			var cell int
+			switch {
+			case t >= 0x40 && t <= 0x7E:
+				cell = int(t) - 0x3F
+			case t >= 0x80 && t <= 0x9E:
+				cell = int(t) - 0x40
+			case t >= 0x9F && t <= 0xFC:
+				row, cell = row+1, int(t)-0x9E
+			}
+			r := jis0208Rune(row, cell)
+			if r == 0 {
+				return "", invalidInput(data, i, "Shift_JIS")
+			}
+			b.WriteRune(r)
+			i++
+		default:
+			return "", invalidInput(data, i, "Shift_JIS")
+		}
+	}
+	return b.String(), nil
+}
+
+func (shiftJISCodec) encode(text string) (string, error) {
+	var b strings.Builder
+	for i, r := range text {
+		switch {
+		case r < 0x80:
+			b.WriteByte(byte(r))
+		case r >= 0xFF61 && r <= 0xFF9F:
+			b.WriteByte(byte(r - 0xFF61 + 0xA1))
+		default:
+			row, cell, ok := jis0208Code(r)
+			if !ok {
+				return "", unrepresentable(text, i, r, "Shift_JIS")
+			}
+			lead := (row+0x21)/2 + 0x70
+			if row > 62 {
+				lead = (row+0x21)/2 + 0xB0
+			}
+			trail := cell + 0x9E
+			if row%2 == 1 {
+				trail = cell + 0x3F
+				if cell > 63 {
+					trail = cell + 0x40
+				}
+			}
+			b.WriteByte(byte(lead))
+			b.WriteByte(byte(trail))
+		}
+	}
+	return b.String(), nil
+}
+
+// iso2022JPCodec handles ISO-2022-JP (RFC 1468), which switches between
+// ASCII and JIS X 0208 with escape sequences and is 7bit clean.
+type iso2022JPCodec struct{}
+
+const (
+	escASCII   = "\x1b(B"
+	escRoman   = "\x1b(J"
+	escJIS1978 = "\x1b$@"
+	escJIS1983 = "\x1b$B"
+)
+
+func (iso2022JPCodec) decode(data string) (string, error) {
+	var b strings.Builder
+	twoByte := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == 0x1b:
+			switch seq := data[i:min(i+3, len(data))]; seq {
+			case escASCII, escRoman:
+				twoByte = false
+			case escJIS1978, escJIS1983:
+				twoByte = true
+			default:
+				return "", invalidInput(data, i, "ISO-2022-JP")
+			}
+			i += 2
+		case c >= 0x80:
+			return "", invalidInput(data, i, "ISO-2022-JP")
+		case !twoByte || c == '\r' || c == '\n':
+			b.WriteByte(c)
+		default:
+			if i+1 >= len(data) {
+				return "", invalidInput(data, i, "ISO-2022-JP")
+			}
+			r := jis0208Rune(int(c)-0x20, int(data[i+1])-0x20)
+			if r == 0 {
+				return "", invalidInput(data, i, "ISO-2022-JP")
+			}
+			b.WriteRune(r)
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+func (iso2022JPCodec) encode(text string) (string, error) {
+	var b strings.Builder
+	twoByte := false
+	for i, r := range text {
+		if r < 0x80 && r != 0x1b {
+			if twoByte {
+				b.WriteString(escASCII)
+				twoByte = false
+			}
+			b.WriteByte(byte(r))
+			continue
+		}
+		row, cell, ok := jis0208Code(r)
+		if !ok {
+			return "", unrepresentable(text, i, r, "ISO-2022-JP")
+		}
+		if !twoByte {
+			b.WriteString(escJIS1983)
+			twoByte = true
+		}
+		b.WriteByte(byte(row + 0x20))
+		b.WriteByte(byte(cell + 0x20))
+	}
+	if twoByte {
+		b.WriteString(escASCII)
+	}
+	return b.String(), nil
+}
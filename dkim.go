@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultDKIMHeaders is the list of headers signed when --dkim-headers is
+// not given. Headers that are missing from the message are skipped.
+const defaultDKIMHeaders = "From:Reply-To:Subject:Date:To:Cc:Message-ID:In-Reply-To:References:MIME-Version:Content-Type:Content-Transfer-Encoding"
+
+// dkimSigner holds the key and parameters for DKIM signing (RFC 6376) with
+// rsa-sha256 or ed25519-sha256 (RFC 8463).
+type dkimSigner struct {
+	key       crypto.Signer
+	algorithm string
+	domain    string // empty to use the domain of each message's From address
+	selector  string
+	headers   []string
+}
+
+func newDKIMSigner(config *Config) (*dkimSigner, error) {
+	if config.DKIMSelector == "" {
+		return nil, fmt.Errorf("--dkim-selector is required with --dkim-key")
+	}
+
+	key, err := loadPrivateKey(config.DKIMKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DKIM key: %w", err)
+	}
+	signer := &dkimSigner{
+		key:      key,
+		domain:   config.DKIMDomain,
+		selector: config.DKIMSelector,
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		signer.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		signer.algorithm = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+
+	headerList := config.DKIMHeaders
+	if headerList == "" {
+		headerList = defaultDKIMHeaders
+	}
+	for _, h := range strings.Split(headerList, ":") {
+		if h = strings.TrimSpace(h); h != "" {
+			signer.headers = append(signer.headers, h)
+		}
+	}
+	return signer, nil
+}
+
+// loadPrivateKey reads the first PEM encoded PKCS#1 RSA, SEC 1 EC or
+// PKCS#8 private key from filename, skipping any other blocks such as
+// certificates.
+func loadPrivateKey(filename string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no private key found", filename)
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("%s: unsupported key type %T", filename, key)
+			}
+			return signer, nil
+		}
+	}
+}
+
+// Sign returns message with a DKIM-Signature header prepended. The message
+// is normalised to CRLF line endings first, as it will be sent that way.
+func (s *dkimSigner) Sign(message string) (string, error) {
+	message = normalizeCRLF(message)
+	header, body := splitMessage(message)
+	fields := parseHeaderFields(header)
+
+	domain := s.domain
+	if domain == "" {
+		m, err := mail.ReadMessage(strings.NewReader(message))
+		if err != nil {
+			return "", fmt.Errorf("DKIM signing failed: %w", err)
+		}
+		from, err := headerAddresses(m.Header, "From")
+		if err != nil || len(from) == 0 {
+			return "", fmt.Errorf("--dkim-domain is required when the message has no From address")
+		}
+		domain = from[0][strings.LastIndex(from[0], "@")+1:]
+	}
+
+	bodyHash := sha256.Sum256([]byte(relaxedBody(body)))
+
+	// Pick header instances bottom-up as described in RFC 6376 section 5.4.2
+	used := make(map[int]bool)
+	var signed []string
+	var names []string
+	for _, name := range s.headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				signed = append(signed, relaxedHeader(fields[i].raw))
+				names = append(names, fields[i].name)
+				break
+			}
+		}
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + s.algorithm,
+		"c=relaxed/relaxed",
+		"d=" + domain,
+		"s=" + s.selector,
+		fmt.Sprintf("t=%d", time.Now().Unix()),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	sigHeader := foldTags("DKIM-Signature: ", tags)
+
+	h := sha256.New()
+	for _, line := range signed {
+		h.Write([]byte(line + "\r\n"))
+	}
+	h.Write([]byte(relaxedHeader(sigHeader)))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, digest)
+	default:
+		sig, err = s.key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("DKIM signing failed: %w", err)
+	}
+
+	return sigHeader + foldBase64(base64.StdEncoding.EncodeToString(sig)) + "\r\n" + message, nil
+}
+
+// foldTags joins tag=value pairs with "; ", starting a new line whenever the
+// current one would exceed 76 characters.
+func foldTags(prefix string, tags []string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	lineLen := len(prefix)
+	for i, tag := range tags {
+		if i > 0 {
+			b.WriteString(";")
+			lineLen++
+			if lineLen+len(tag)+1 > 76 {
+				b.WriteString("\r\n\t")
+				lineLen = 1
+			} else {
+				b.WriteString(" ")
+				lineLen++
+			}
+		}
+		b.WriteString(tag)
+		lineLen += len(tag)
+	}
+	return b.String()
+}
+
+// foldBase64 breaks a base64 tag value into folded lines.
+func foldBase64(value string) string {
+	var b strings.Builder
+	for len(value) > 0 {
+		n := min(len(value), 72)
+		b.WriteString("\r\n\t" + value[:n])
+		value = value[n:]
+	}
+	return b.String()
+}
+
+// headerField is a single, possibly folded, header field.
+type headerField struct {
+	name string
+	raw  string // complete field without the final CRLF
+}
+
+// parseHeaderFields splits a header block into fields, keeping continuation
+// lines with the field they belong to.
+func parseHeaderFields(header string) []headerField {
+	var fields []headerField
+	for _, line := range strings.Split(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += "\r\n" + line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+	}
+	return fields
+}
+
+// splitMessage returns the header block (including the CRLF ending its last
+// line) and the body of a CRLF message.
+func splitMessage(message string) (string, string) {
+	if strings.HasPrefix(message, "\r\n") {
+		return "", message[2:]
+	}
+	if i := strings.Index(message, "\r\n\r\n"); i >= 0 {
+		return message[:i+2], message[i+4:]
+	}
+	return message, ""
+}
+
+// splitMIMEEntity separates the message headers from the MIME entity, i.e.
+// the Content-* headers and the body, so that the entity can be wrapped in a
+// signed or encrypted container.
+func splitMIMEEntity(message string) (string, string) {
+	header, body := splitMessage(normalizeCRLF(message))
+	var outer, inner strings.Builder
+	for _, field := range parseHeaderFields(header) {
+		if strings.HasPrefix(strings.ToLower(field.name), "content-") {
+			inner.WriteString(field.raw + "\r\n")
+		} else {
+			outer.WriteString(field.raw + "\r\n")
+		}
+	}
+	return outer.String(), inner.String() + "\r\n" + body
+}
+
+// normalizeCRLF converts bare LF line endings to CRLF.
+func normalizeCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// relaxedHeader applies the "relaxed" header canonicalization to a field.
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// relaxedBody applies the "relaxed" body canonicalization.
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		fields := strings.FieldsFunc(line, isWSP)
+		line = strings.Join(fields, " ")
+		if len(fields) > 0 && isWSP(rune(lines[i][0])) {
+			line = " " + line
+		}
+		lines[i] = line
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
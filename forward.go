@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// readMessageFile reads an existing message for --forward or --bounce and
+// converts it to CRLF line endings without otherwise changing it.
+func readMessageFile(filename string) (string, mail.Header, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	message := normalizeCRLF(string(data))
+	m, err := mail.ReadMessage(strings.NewReader(message))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid message %s: %w", filename, err)
+	}
+	return message, m.Header, nil
+}
+
+// forwardPart returns a writer for a message/rfc822 part holding the
+// message in filename. The message is embedded unchanged, so it is sent with
+// an identity transfer encoding as RFC 2046 requires.
+func forwardPart(filename string) partWriter {
+	return func(buf *strings.Builder) error {
+		message, header, err := readMessageFile(filename)
+		if err != nil {
+			return err
+		}
+
+		encoding := "7bit"
+		for _, line := range strings.Split(message, "\r\n") {
+			if len(line) > 998 {
+				return fmt.Errorf("cannot forward %s: line longer than 998 characters", filename)
+			}
+			if !isPrintableASCII(strings.ReplaceAll(line, "\t", " ")) {
+				encoding = "8bit"
+			}
+		}
+
+		name := "forwarded.eml"
+		if subject := decodeHeaderText(header.Get("Subject")); subject != "" {
+			name = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(`/\:*?"<>|`, r) || r < 0x20 {
+					return '_'
+				}
+				return r
+			}, subject) + ".eml"
+		}
+
+		buf.WriteString("Content-Type: message/rfc822\r\n")
+		buf.WriteString("Content-Transfer-Encoding: " + encoding + "\r\n")
+		writeParamHeader(buf, "Content-Disposition", "attachment", encodeParam("filename", name))
+		buf.WriteString("\r\n")
+		buf.WriteString(message)
+		// The final CRLF would otherwise be taken as part of the delimiter
+		if strings.HasSuffix(message, "\r\n") {
+			buf.WriteString("\r\n")
+		}
+		return nil
+	}
+}
+
+// forwardSubject returns the "Fwd:" subject for forwarding the first
+// --forward message, or "" if it cannot be read.
+func forwardSubject(filename string) string {
+	_, header, err := readMessageFile(filename)
+	if err != nil {
+		return ""
+	}
+	subject := decodeHeaderText(header.Get("Subject"))
+	if subject == "" || strings.HasPrefix(strings.ToLower(subject), "fwd:") {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// bounceMessage redirects the --bounce message unchanged to the recipients
+// given on the command line by prepending a block of Resent-* headers
+// (RFC 5322 section 3.6.6).
+func bounceMessage(config *Config) (string, error) {
+	if config.From == "" {
+		return "", fmt.Errorf("--bounce requires --from")
+	}
+	if len(config.To) == 0 && len(config.Cc) == 0 && len(config.Bcc) == 0 {
+		return "", fmt.Errorf("--bounce requires --to, --cc or --bcc")
+	}
+	message, _, err := readMessageFile(config.Bounce)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("Resent-Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	from, err := formatAddressList("Resent-From", []string{config.From}, config.Charset)
+	if err != nil {
+		return "", err
+	}
+	b.WriteString("Resent-From: " + from + "\r\n")
+	for _, h := range []struct {
+		name string
+		list []string
+	}{
+		{"Resent-To", config.To},
+		{"Resent-Cc", config.Cc},
+	} {
+		if len(h.list) == 0 {
+			continue
+		}
+		value, err := formatAddressList(h.name, h.list, config.Charset)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(h.name + ": " + value + "\r\n")
+	}
+	b.WriteString("Resent-Message-ID: " + newMessageID() + "\r\n")
+	return b.String() + message, nil
+}
+
+// decodeHeaderText decodes RFC 2047 encoded-words, returning the raw value
+// if it cannot be decoded.
+func decodeHeaderText(value string) string {
+	decoded, err := headerWordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// cleanHTML prepares an HTML body for mail clients, many of which (Gmail
+// among them) ignore <style> elements and refuse active content. Rules from
+// <style> elements are copied into the style attributes of the elements they
+// match, following the CSS cascade; rules that cannot be inlined, such as
+// @media queries and :hover, stay in a <style> element. Scripts, event
+// handler attributes, URLs with schemes other than those in safeURLSchemes,
+// embedded frames and objects, forms that submit to another site, refresh
+// redirects, <base> and external stylesheets are removed. The
+// returned warnings describe removed content and remote images, which most
+// clients block until the recipient allows them.
+func cleanHTML(src string) (string, []string) {
+	doc := parseHTML(src)
+	var warnings []string
+
+	// Collect the inlinable rules from the style sheets
+	var rules []cssRule
+	var keep []string
+	var styles []*htmlNode
+	walkHTML(doc, func(n *htmlNode) bool {
+		if n.tag != "style" {
+			return true
+		}
+		if media := strings.ToLower(strings.TrimSpace(n.attr("media"))); media != "" && media != "all" && media != "screen" {
+			return false
+		}
+		r, k := parseStylesheet(n.textContent(), len(rules))
+		rules = append(rules, r...)
+		if k != "" {
+			keep = append(keep, k)
+		}
+		styles = append(styles, n)
+		return false
+	})
+	for i, n := range styles {
+		if i == 0 && len(keep) > 0 {
+			n.children = []*htmlNode{{kind: htmlText, text: "\n" + strings.Join(keep, "\n") + "\n", parent: n}}
+			continue
+		}
+		removeNode(n)
+	}
+
+	walkHTML(doc, func(n *htmlNode) bool {
+		switch n.tag {
+		case "script", "iframe", "frame", "frameset", "object", "embed", "applet":
+			warnings = append(warnings, fmt.Sprintf("removed <%s> element", n.tag))
+			removeNode(n)
+			return false
+		case "form":
+			if action := n.attr("action"); isRemoteURL(action) {
+				warnings = append(warnings, fmt.Sprintf("removed form submitting to %s", action))
+				removeNode(n)
+				return false
+			}
+		case "base":
+			warnings = append(warnings, "removed <base> element")
+			removeNode(n)
+			return false
+		case "meta":
+			if strings.EqualFold(strings.TrimSpace(n.attr("http-equiv")), "refresh") {
+				warnings = append(warnings, "removed <meta http-equiv=\"refresh\"> element")
+				removeNode(n)
+				return false
+			}
+		case "link":
+			if slices.Contains(strings.Fields(strings.ToLower(n.attr("rel"))), "stylesheet") {
+				warnings = append(warnings, fmt.Sprintf("removed external stylesheet %s, mail clients do not load it", n.attr("href")))
+				removeNode(n)
+				return false
+			}
+		case "img":
+			if src := n.attr("src"); isRemoteURL(src) {
+				warnings = append(warnings, fmt.Sprintf("remote image %s is not shown by most clients until the recipient allows it", src))
+			}
+		case "style", "title":
+			return false
+		}
+
+		for _, a := range append([]htmlAttr(nil), n.attrs...) {
+			switch {
+			case strings.HasPrefix(a.name, "on"), a.name == "srcdoc":
+				n.removeAttr(a.name)
+			case a.name == "srcset":
+				for _, candidate := range strings.Split(a.value, ",") {
+					if fields := strings.Fields(candidate); len(fields) > 0 && !isSafeURL(fields[0]) {
+						n.removeAttr(a.name)
+						break
+					}
+				}
+			case htmlURLAttributes[a.name] && !isSafeURL(a.value):
+				warnings = append(warnings, fmt.Sprintf("removed %s URL %q from <%s>", a.name, a.value, n.tag))
+				n.removeAttr(a.name)
+			}
+		}
+		if len(rules) > 0 && !hasOpen(n, "head", nil) {
+			applyCSSRules(n, rules)
+		}
+		return true
+	})
+
+	var b strings.Builder
+	doc.render(&b)
+	return b.String(), warnings
+}
+
+// walkHTML calls fn for every element in document order. Children are
+// visited only if fn returns true. fn may remove the element it is given.
+func walkHTML(n *htmlNode, fn func(*htmlNode) bool) {
+	for _, c := range append([]*htmlNode(nil), n.children...) {
+		if c.kind == htmlElement && fn(c) {
+			walkHTML(c, fn)
+		}
+	}
+}
+
+func removeNode(n *htmlNode) {
+	p := n.parent
+	p.children = slices.DeleteFunc(p.children, func(c *htmlNode) bool { return c == n })
+}
+
+// htmlURLAttributes are the attributes whose value is a URL.
+var htmlURLAttributes = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "background": true, "poster": true,
+	"cite": true, "longdesc": true, "lowsrc": true, "dynsrc": true, "data": true, "xlink:href": true,
+}
+
+// safeURLSchemes are the URL schemes allowed in cleaned HTML and rendered
+// Markdown. Relative URLs are allowed as well.
+var safeURLSchemes = []string{"http", "https", "mailto", "cid", "tel"}
+
+// isSafeURL reports whether url is relative or uses one of safeURLSchemes.
+// Like a browser it ignores tabs and newlines anywhere in the URL and
+// control characters and spaces before it.
+func isSafeURL(url string) bool {
+	url = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, url)
+	url = strings.TrimLeftFunc(url, func(r rune) bool { return r <= ' ' })
+	scheme, _, ok := strings.Cut(url, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return true
+	}
+	return slices.Contains(safeURLSchemes, strings.ToLower(scheme))
+}
+
+func isRemoteURL(url string) bool {
+	url = strings.ToLower(strings.TrimSpace(url))
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "//")
+}
+
+// cssRule is a style rule with a single selector.
+type cssRule struct {
+	selector *cssSelector
+	decls    []cssDecl
+	order    int
+}
+
+type cssDecl struct {
+	property  string
+	value     string
+	important bool
+}
+
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// parseStylesheet splits a style sheet into the rules that can be inlined,
+// numbered from order, and the source of those that cannot.
+func parseStylesheet(css string, order int) ([]cssRule, string) {
+	css = cssComment.ReplaceAllString(css, "")
+	css = strings.NewReplacer("<!--", "", "-->", "").Replace(css)
+	var rules []cssRule
+	var keep []string
+	for i := 0; i < len(css); {
+		rest := strings.TrimLeft(css[i:], " \t\r\n\f")
+		i = len(css) - len(rest)
+		if rest == "" {
+			break
+		}
+		open := strings.IndexAny(rest, "{;")
+		if open < 0 {
+			break
+		}
+		if rest[open] == ';' {
+			// @import, @charset and other statements
+			keep = append(keep, strings.TrimSpace(rest[:open+1]))
+			i += open + 1
+			continue
+		}
+		end := matchingBrace(rest, open)
+		prelude := strings.TrimSpace(rest[:open])
+		body := rest[open+1 : max(end, open+1)]
+		i += min(end+1, len(rest))
+		if strings.HasPrefix(prelude, "@") {
+			keep = append(keep, prelude+" {"+body+"}")
+			continue
+		}
+
+		decls := parseDeclarations(body)
+		var unsupported []string
+		for _, sel := range strings.Split(prelude, ",") {
+			sel = strings.TrimSpace(sel)
+			if parsed, ok := parseSelector(sel); ok {
+				rules = append(rules, cssRule{selector: parsed, decls: decls, order: order + len(rules)})
+			} else if sel != "" {
+				unsupported = append(unsupported, sel)
+			}
+		}
+		if len(unsupported) > 0 {
+			keep = append(keep, strings.Join(unsupported, ", ")+" {"+body+"}")
+		}
+	}
+	return rules, strings.Join(keep, "\n")
+}
+
+// matchingBrace returns the index of the brace closing the one at open.
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case '"', '\'':
+			if end := strings.IndexByte(s[i+1:], s[i]); end >= 0 {
+				i += end + 1
+			}
+		}
+	}
+	return len(s)
+}
+
+// parseDeclarations parses the declarations of a rule or style attribute.
+func parseDeclarations(s string) []cssDecl {
+	var decls []cssDecl
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			c := s[i]
+			switch {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c == '(':
+				depth++
+				continue
+			case c == ')':
+				depth--
+				continue
+			case c != ';' || depth > 0:
+				continue
+			}
+		}
+		prop, value, ok := strings.Cut(s[start:i], ":")
+		start = i + 1
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		value = strings.TrimSpace(value)
+		if !ok || prop == "" || value == "" {
+			continue
+		}
+		d := cssDecl{property: prop, value: value}
+		if idx := strings.LastIndex(strings.ToLower(value), "!important"); idx >= 0 && strings.TrimSpace(value[idx+len("!important"):]) == "" {
+			d.value = strings.TrimSpace(value[:idx])
+			d.important = true
+		}
+		decls = append(decls, d)
+	}
+	return decls
+}
+
+// applyCSSRules merges the declarations of the rules matching n into its
+// style attribute. Declarations already in the attribute win over the style
+// sheet unless the sheet marks them !important; otherwise the more specific
+// and then the later rule wins.
+func applyCSSRules(n *htmlNode, rules []cssRule) {
+	type candidate struct {
+		decl        cssDecl
+		inline      bool
+		specificity [3]int
+		order       int
+	}
+	var candidates []candidate
+	for _, r := range rules {
+		if r.selector.matches(n) {
+			for _, d := range r.decls {
+				candidates = append(candidates, candidate{d, false, r.selector.specificity, r.order})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	for i, d := range parseDeclarations(n.attr("style")) {
+		candidates = append(candidates, candidate{d, true, [3]int{}, i})
+	}
+
+	// Sort by precedence, lowest first, so later entries override
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.decl.important != b.decl.important {
+			return !a.decl.important
+		}
+		if a.inline != b.inline {
+			return !a.inline
+		}
+		if a.specificity != b.specificity {
+			for k := range a.specificity {
+				if a.specificity[k] != b.specificity[k] {
+					return a.specificity[k] < b.specificity[k]
+				}
+			}
+		}
+		return a.order < b.order
+	})
+
+	var props []string
+	values := map[string]string{}
+	for _, c := range candidates {
+		if _, ok := values[c.decl.property]; !ok {
+			props = append(props, c.decl.property)
+		}
+		value := c.decl.value
+		if c.inline && c.decl.important {
+			value += " !important"
+		}
+		values[c.decl.property] = value
+	}
+	var style []string
+	for _, p := range props {
+		style = append(style, p+": "+values[p])
+	}
+	n.setAttr("style", strings.Join(style, "; "))
+}
+
+// cssSelector is a complex selector: compound selectors joined by
+// combinators (' ', '>', '+' or '~').
+type cssSelector struct {
+	compounds   []cssCompound
+	combinators []byte
+	specificity [3]int
+}
+
+type cssCompound struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []cssAttrSelector
+	pseudo  []string
+}
+
+type cssAttrSelector struct {
+	name  string
+	op    string
+	value string
+}
+
+// parseSelector parses the selectors that can be evaluated statically:
+// type, universal, class, ID and attribute selectors, the four combinators
+// and :first-child, :last-child and :only-child. It returns false for
+// anything else, such as :hover or ::before.
+func parseSelector(s string) (*cssSelector, bool) {
+	sel := &cssSelector{}
+	cur := cssCompound{}
+	empty := true
+	var pending byte
+
+	ident := func(i int) (string, int) {
+		start := i
+		for i < len(s) && (isASCIILetter(s[i]) || s[i] >= '0' && s[i] <= '9' || s[i] == '-' || s[i] == '_' || s[i] >= 0x80) {
+			i++
+		}
+		return s[start:i], i
+	}
+	finish := func() bool {
+		if empty {
+			return false
+		}
+		if len(sel.compounds) > 0 {
+			sel.combinators = append(sel.combinators, pending)
+		}
+		sel.compounds = append(sel.compounds, cur)
+		cur, empty, pending = cssCompound{}, true, 0
+		return true
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if !empty && !finish() {
+				return nil, false
+			}
+			if pending == 0 && len(sel.compounds) > 0 {
+				pending = ' '
+			}
+			i++
+		case c == '>' || c == '+' || c == '~':
+			if !empty && !finish() {
+				return nil, false
+			}
+			if len(sel.compounds) == 0 {
+				return nil, false
+			}
+			pending = c
+			i++
+		case c == '*':
+			empty = false
+			i++
+		case c == '#' || c == '.':
+			name, j := ident(i + 1)
+			if name == "" {
+				return nil, false
+			}
+			if c == '#' {
+				cur.id = name
+				sel.specificity[0]++
+			} else {
+				cur.classes = append(cur.classes, name)
+				sel.specificity[1]++
+			}
+			empty = false
+			i = j
+		case c == '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, false
+			}
+			attr, ok := parseAttrSelector(s[i+1 : i+end])
+			if !ok {
+				return nil, false
+			}
+			cur.attrs = append(cur.attrs, attr)
+			sel.specificity[1]++
+			empty = false
+			i += end + 1
+		case c == ':':
+			name, j := ident(i + 1)
+			name = strings.ToLower(name)
+			if name != "first-child" && name != "last-child" && name != "only-child" {
+				return nil, false
+			}
+			cur.pseudo = append(cur.pseudo, name)
+			sel.specificity[1]++
+			empty = false
+			i = j
+		case isASCIILetter(c):
+			name, j := ident(i)
+			cur.tag = strings.ToLower(name)
+			sel.specificity[2]++
+			empty = false
+			i = j
+		default:
+			return nil, false
+		}
+	}
+	if empty || !finish() {
+		return nil, false
+	}
+	return sel, true
+}
+
+func parseAttrSelector(s string) (cssAttrSelector, bool) {
+	s = strings.TrimSpace(s)
+	idx := strings.IndexAny(s, "~^$*|=")
+	if idx < 0 {
+		return cssAttrSelector{name: strings.ToLower(s)}, s != ""
+	}
+	attr := cssAttrSelector{name: strings.ToLower(strings.TrimSpace(s[:idx]))}
+	op := s[idx : idx+1]
+	rest := s[idx+1:]
+	if op != "=" {
+		if !strings.HasPrefix(rest, "=") {
+			return attr, false
+		}
+		op += "="
+		rest = rest[1:]
+	}
+	attr.op = op
+	attr.value = strings.Trim(strings.TrimSpace(rest), `"'`)
+	return attr, attr.name != ""
+}
+
+// matches reports whether the selector matches element n.
+func (s *cssSelector) matches(n *htmlNode) bool {
+	return s.matchAt(n, len(s.compounds)-1)
+}
+
+func (s *cssSelector) matchAt(n *htmlNode, i int) bool {
+	if !s.compounds[i].matches(n) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	switch s.combinators[i-1] {
+	case ' ':
+		for p := n.parent; p != nil && p.kind == htmlElement; p = p.parent {
+			if s.matchAt(p, i-1) {
+				return true
+			}
+		}
+	case '>':
+		return n.parent != nil && n.parent.kind == htmlElement && s.matchAt(n.parent, i-1)
+	case '+':
+		prev := previousElement(n)
+		return prev != nil && s.matchAt(prev, i-1)
+	case '~':
+		for prev := previousElement(n); prev != nil; prev = previousElement(prev) {
+			if s.matchAt(prev, i-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *cssCompound) matches(n *htmlNode) bool {
+	if c.tag != "" && c.tag != n.tag {
+		return false
+	}
+	if c.id != "" && n.attr("id") != c.id {
+		return false
+	}
+	classes := strings.Fields(n.attr("class"))
+	for _, class := range c.classes {
+		if !slices.Contains(classes, class) {
+			return false
+		}
+	}
+	for _, a := range c.attrs {
+		if !n.hasAttr(a.name) {
+			return false
+		}
+		v := n.attr(a.name)
+		var ok bool
+		switch a.op {
+		case "":
+			ok = true
+		case "=":
+			ok = v == a.value
+		case "~=":
+			ok = slices.Contains(strings.Fields(v), a.value)
+		case "^=":
+			ok = a.value != "" && strings.HasPrefix(v, a.value)
+		case "$=":
+			ok = a.value != "" && strings.HasSuffix(v, a.value)
+		case "*=":
+			ok = a.value != "" && strings.Contains(v, a.value)
+		case "|=":
+			ok = v == a.value || strings.HasPrefix(v, a.value+"-")
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, p := range c.pseudo {
+		first := previousElement(n) == nil
+		last := nextElement(n) == nil
+		if p == "first-child" && !first || p == "last-child" && !last || p == "only-child" && !(first && last) {
+			return false
+		}
+	}
+	return true
+}
+
+// previousElement returns the element sibling before n, skipping text.
+func previousElement(n *htmlNode) *htmlNode {
+	siblings := n.parent.children
+	for i := slices.Index(siblings, n) - 1; i >= 0; i-- {
+		if siblings[i].kind == htmlElement {
+			return siblings[i]
+		}
+	}
+	return nil
+}
+
+// nextElement returns the element sibling after n, skipping text.
+func nextElement(n *htmlNode) *htmlNode {
+	siblings := n.parent.children
+	for i := slices.Index(siblings, n) + 1; i < len(siblings); i++ {
+		if siblings[i].kind == htmlElement {
+			return siblings[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"html"
+	"slices"
+	"strings"
+)
+
+// htmlNode is an element, text, comment or doctype in a parsed HTML
+// document. Text keeps its original entity references; element attribute
+// values are unescaped.
+type htmlNode struct {
+	kind     htmlNodeKind
+	tag      string // lower case element name
+	attrs    []htmlAttr
+	text     string // text, comment or doctype source
+	parent   *htmlNode
+	children []*htmlNode
+}
+
+type htmlNodeKind int
+
+const (
+	htmlDocument htmlNodeKind = iota
+	htmlElement
+	htmlText
+	htmlComment
+	htmlDoctype
+)
+
+type htmlAttr struct {
+	name  string
+	value string
+}
+
+// htmlVoidElements have no content and no end tag.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+	"link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// htmlRawTextElements contain text up to their end tag, without markup.
+var htmlRawTextElements = map[string]bool{
+	"script": true, "style": true, "textarea": true, "title": true,
+}
+
+// htmlBlockElements start a new block in rendering and close an open <p>.
+var htmlBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "body": true, "center": true,
+	"dd": true, "details": true, "dialog": true, "div": true, "dl": true, "dt": true, "fieldset": true,
+	"figcaption": true, "figure": true, "footer": true, "form": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "header": true, "hr": true, "html": true, "li": true, "main": true,
+	"nav": true, "ol": true, "p": true, "pre": true, "section": true, "table": true, "tbody": true,
+	"td": true, "tfoot": true, "th": true, "thead": true, "tr": true, "ul": true,
+}
+
+// htmlImpliedEnd lists, for elements whose end tag may be omitted, the
+// start tags that close them and the elements that bound the search for an
+// open one.
+var htmlImpliedEnd = map[string]struct{ closedBy, scope []string }{
+	"li": {[]string{"li"}, []string{"ul", "ol"}},
+	"dt": {[]string{"dt", "dd"}, []string{"dl"}},
+	"dd": {[]string{"dt", "dd"}, []string{"dl"}},
+	"tr": {[]string{"tr", "tbody", "thead", "tfoot"}, []string{"table"}},
+	"td": {[]string{"td", "th", "tr", "tbody", "thead", "tfoot"}, []string{"table"}},
+	"th": {[]string{"td", "th", "tr", "tbody", "thead", "tfoot"}, []string{"table"}},
+	"option": {[]string{"option", "optgroup"}, []string{"select"}},
+}
+
+// parseHTML parses an HTML document leniently into a tree. It handles the
+// markup found in email bodies: unclosed paragraphs and list items, void
+// elements, raw text elements and stray end tags, which are ignored.
+func parseHTML(src string) *htmlNode {
+	doc := &htmlNode{kind: htmlDocument}
+	cur := doc
+	appendChild := func(n *htmlNode) {
+		n.parent = cur
+		cur.children = append(cur.children, n)
+	}
+	// closeTo makes the parent of the innermost open element named tag the
+	// current node, searching no further than the stop elements.
+	closeTo := func(tags []string, stop []string) bool {
+		for n := cur; n != doc; n = n.parent {
+			if slices.Contains(tags, n.tag) {
+				cur = n.parent
+				return true
+			}
+			if slices.Contains(stop, n.tag) {
+				return false
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < len(src); {
+		lt := strings.IndexByte(src[i:], '<')
+		if lt < 0 {
+			appendChild(&htmlNode{kind: htmlText, text: src[i:]})
+			break
+		}
+		if lt > 0 {
+			appendChild(&htmlNode{kind: htmlText, text: src[i : i+lt]})
+			i += lt
+		}
+		rest := src[i:]
+
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := strings.Index(rest[4:], "-->")
+			if end < 0 {
+				appendChild(&htmlNode{kind: htmlComment, text: rest[4:]})
+				i = len(src)
+				continue
+			}
+			appendChild(&htmlNode{kind: htmlComment, text: rest[4 : 4+end]})
+			i += 4 + end + 3
+			continue
+
+		case strings.HasPrefix(rest, "<!") || strings.HasPrefix(rest, "<?"):
+			end := strings.IndexByte(rest, '>')
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			appendChild(&htmlNode{kind: htmlDoctype, text: rest[:end+1]})
+			i += end + 1
+			continue
+
+		case strings.HasPrefix(rest, "</"):
+			name, _ := scanTagName(rest[2:])
+			if name == "" {
+				appendChild(&htmlNode{kind: htmlText, text: "&lt;"})
+				i++
+				continue
+			}
+			end := strings.IndexByte(rest, '>')
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			var scope []string
+			if slices.Contains([]string{"td", "th", "tr", "tbody", "thead", "tfoot"}, name) {
+				scope = []string{"table"}
+			}
+			closeTo([]string{name}, scope)
+			i += end + 1
+			continue
+		}
+
+		name, n := scanTagName(rest[1:])
+		if name == "" {
+			appendChild(&htmlNode{kind: htmlText, text: "&lt;"})
+			i++
+			continue
+		}
+		attrs, selfClosing, length := scanAttributes(rest[1+n:])
+		i += 1 + n + length
+
+		// Close elements whose end tag is implied by this start tag
+		for _, open := range []string{"li", "dt", "dd", "td", "th", "tr", "option"} {
+			if rule := htmlImpliedEnd[open]; slices.Contains(rule.closedBy, name) && hasOpen(cur, open, rule.scope) {
+				closeTo([]string{open}, rule.scope)
+			}
+		}
+		if htmlBlockElements[name] {
+			closeTo([]string{"p"}, []string{"div", "li", "td", "th", "blockquote", "table", "body"})
+		}
+
+		el := &htmlNode{kind: htmlElement, tag: name, attrs: attrs}
+		appendChild(el)
+		if htmlVoidElements[name] || selfClosing {
+			continue
+		}
+		if htmlRawTextElements[name] {
+			end := indexFold(src[i:], "</"+name)
+			if end < 0 {
+				end = len(src) - i
+			}
+			if end > 0 {
+				el.children = []*htmlNode{{kind: htmlText, text: src[i : i+end], parent: el}}
+			}
+			i += end
+			if gt := strings.IndexByte(src[i:], '>'); gt >= 0 {
+				i += gt + 1
+			}
+			continue
+		}
+		cur = el
+	}
+	return doc
+}
+
+// hasOpen reports whether an element named tag is open at n, without
+// crossing one of the scope elements.
+func hasOpen(n *htmlNode, tag string, scope []string) bool {
+	for ; n != nil && n.kind == htmlElement; n = n.parent {
+		if n.tag == tag {
+			return true
+		}
+		if slices.Contains(scope, n.tag) {
+			return false
+		}
+	}
+	return false
+}
+
+// indexFold is strings.Index ignoring ASCII case.
+func indexFold(s, substr string) int {
+	return strings.Index(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// scanTagName returns the lower case tag name at the start of s and its
+// length.
+func scanTagName(s string) (string, int) {
+	n := 0
+	for n < len(s) && (isASCIILetter(s[n]) || n > 0 && (s[n] >= '0' && s[n] <= '9' || s[n] == '-' || s[n] == ':')) {
+		n++
+	}
+	return strings.ToLower(s[:n]), n
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// scanAttributes parses the attributes of a start tag up to and including
+// the closing ">". It returns the attributes, whether the tag ended in "/>"
+// and the number of bytes consumed.
+func scanAttributes(s string) ([]htmlAttr, bool, int) {
+	var attrs []htmlAttr
+	i := 0
+	for i < len(s) {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == '\f') {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		if s[i] == '>' {
+			return attrs, false, i + 1
+		}
+		if strings.HasPrefix(s[i:], "/>") {
+			return attrs, true, i + 2
+		}
+		start := i
+		for i < len(s) && !strings.ContainsRune(" \t\n\r\f/>=", rune(s[i])) {
+			i++
+		}
+		if i == start {
+			i++ // stray "/"
+			continue
+		}
+		attr := htmlAttr{name: strings.ToLower(s[start:i])}
+		j := i
+		for j < len(s) && strings.ContainsRune(" \t\n\r\f", rune(s[j])) {
+			j++
+		}
+		if j < len(s) && s[j] == '=' {
+			j++
+			for j < len(s) && strings.ContainsRune(" \t\n\r\f", rune(s[j])) {
+				j++
+			}
+			if j < len(s) && (s[j] == '"' || s[j] == '\'') {
+				end := strings.IndexByte(s[j+1:], s[j])
+				if end < 0 {
+					end = len(s) - j - 1
+				}
+				attr.value = html.UnescapeString(s[j+1 : j+1+end])
+				i = min(j+1+end+1, len(s))
+			} else {
+				k := j
+				for k < len(s) && !strings.ContainsRune(" \t\n\r\f>", rune(s[k])) {
+					k++
+				}
+				attr.value = html.UnescapeString(s[j:k])
+				i = k
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, false, len(s)
+}
+
+// attr returns the value of the named attribute.
+func (n *htmlNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.name == name {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// hasAttr reports whether the element has the named attribute.
+func (n *htmlNode) hasAttr(name string) bool {
+	for _, a := range n.attrs {
+		if a.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setAttr sets or adds an attribute.
+func (n *htmlNode) setAttr(name, value string) {
+	for i, a := range n.attrs {
+		if a.name == name {
+			n.attrs[i].value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, htmlAttr{name, value})
+}
+
+// removeAttr deletes an attribute.
+func (n *htmlNode) removeAttr(name string) {
+	for i, a := range n.attrs {
+		if a.name == name {
+			n.attrs = append(n.attrs[:i], n.attrs[i+1:]...)
+			return
+		}
+	}
+}
+
+// render serializes the tree back to HTML.
+func (n *htmlNode) render(b *strings.Builder) {
+	switch n.kind {
+	case htmlText:
+		b.WriteString(n.text)
+		return
+	case htmlComment:
+		b.WriteString("<!--" + n.text + "-->")
+		return
+	case htmlDoctype:
+		b.WriteString(n.text)
+		return
+	case htmlElement:
+		b.WriteString("<" + n.tag)
+		for _, a := range n.attrs {
+			b.WriteString(" " + a.name + "=\"" + strings.NewReplacer("&", "&amp;", "\"", "&quot;").Replace(a.value) + "\"")
+		}
+		b.WriteString(">")
+		if htmlVoidElements[n.tag] {
+			return
+		}
+	}
+	for _, c := range n.children {
+		c.render(b)
+	}
+	if n.kind == htmlElement {
+		b.WriteString("</" + n.tag + ">")
+	}
+}
+
+// textContent returns the unescaped text of the node and its descendants.
+func (n *htmlNode) textContent() string {
+	if n.kind == htmlText {
+		if n.parent != nil && htmlRawTextElements[n.parent.tag] && n.parent.tag != "title" && n.parent.tag != "textarea" {
+			return n.text
+		}
+		return html.UnescapeString(n.text)
+	}
+	var b strings.Builder
+	for _, c := range n.children {
+		b.WriteString(c.textContent())
+	}
+	return b.String()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// htmlTextConverter renders an HTML body as plain text for the
+// multipart/alternative text part. Links become numbered footnotes, lists
+// get bullets or numbers, headings are underlined and data tables are laid
+// out in columns. Tables used only for layout are flattened.
+type htmlTextConverter struct {
+	links []string
+}
+
+// lineBreak marks a <br> in inline text until whitespace has been collapsed.
+const lineBreak = "\x00"
+
+var multipleBlankLines = regexp.MustCompile(`\n{3,}`)
+
+// htmlToText converts an HTML document to plain text.
+func htmlToText(src string) string {
+	c := &htmlTextConverter{}
+	text := c.blocks(parseHTML(src), "\n\n")
+	text = strings.TrimSpace(multipleBlankLines.ReplaceAllString(text, "\n\n"))
+	if len(c.links) > 0 {
+		text += "\n\n"
+		for i, link := range c.links {
+			text += fmt.Sprintf("[%d] %s\n", i+1, link)
+		}
+	}
+	return strings.TrimRight(text, "\n") + "\n"
+}
+
+// blocks renders the children of n, joining block-level parts with sep.
+func (c *htmlTextConverter) blocks(n *htmlNode, sep string) string {
+	var parts []string
+	var inline strings.Builder
+	flush := func() {
+		if text := collapseWhitespace(inline.String()); text != "" {
+			parts = append(parts, text)
+		}
+		inline.Reset()
+	}
+	for _, child := range n.children {
+		if child.kind == htmlElement && htmlBlockElements[child.tag] {
+			flush()
+			if text := c.block(child); strings.TrimSpace(text) != "" {
+				parts = append(parts, text)
+			}
+			continue
+		}
+		inline.WriteString(c.inline(child))
+	}
+	flush()
+	return strings.Join(parts, sep)
+}
+
+// block renders a block-level element.
+func (c *htmlTextConverter) block(n *htmlNode) string {
+	switch n.tag {
+	case "h1", "h2":
+		text := collapseWhitespace(c.inlineChildren(n))
+		underline := "="
+		if n.tag == "h2" {
+			underline = "-"
+		}
+		return text + "\n" + strings.Repeat(underline, maxLineWidth(text))
+	case "h3", "h4", "h5", "h6":
+		level, _ := strconv.Atoi(n.tag[1:])
+		return strings.Repeat("#", level) + " " + collapseWhitespace(c.inlineChildren(n))
+	case "hr":
+		return strings.Repeat("-", 40)
+	case "pre":
+		return strings.TrimPrefix(strings.TrimRight(n.textContent(), "\n"), "\n")
+	case "blockquote":
+		return prefixLines(c.blocks(n, "\n\n"), "> ", "> ")
+	case "ul", "ol":
+		return c.list(n)
+	case "dd":
+		return prefixLines(c.blocks(n, "\n"), "    ", "    ")
+	case "table":
+		return c.table(n)
+	case "li":
+		// A list item outside a list
+		return prefixLines(c.blocks(n, "\n"), "* ", "  ")
+	}
+	return c.blocks(n, "\n\n")
+}
+
+// inline renders an inline node.
+func (c *htmlTextConverter) inline(n *htmlNode) string {
+	switch n.kind {
+	case htmlText:
+		return n.textContent()
+	case htmlElement:
+	default:
+		return ""
+	}
+
+	switch n.tag {
+	case "head", "script", "style", "title", "template", "noscript", "select", "textarea", "button":
+		return ""
+	case "br":
+		return lineBreak
+	case "img":
+		if alt := strings.TrimSpace(n.attr("alt")); alt != "" {
+			return "[" + alt + "]"
+		}
+		return ""
+	case "a":
+		text := c.inlineChildren(n)
+		href := strings.TrimSpace(n.attr("href"))
+		label := collapseWhitespace(text)
+		if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+			return text
+		}
+		if label == "" {
+			return strings.TrimPrefix(href, "mailto:")
+		}
+		if label == href || label == strings.TrimPrefix(href, "mailto:") {
+			return text
+		}
+		c.links = append(c.links, href)
+		return text + fmt.Sprintf(" [%d]", len(c.links))
+	}
+	if htmlBlockElements[n.tag] {
+		// A block inside an inline element
+		return " " + c.blocks(n, " ") + " "
+	}
+	return c.inlineChildren(n)
+}
+
+func (c *htmlTextConverter) inlineChildren(n *htmlNode) string {
+	var b strings.Builder
+	for _, child := range n.children {
+		b.WriteString(c.inline(child))
+	}
+	return b.String()
+}
+
+// list renders a ul or ol with bullets or numbers, indenting the
+// continuation lines of each item.
+func (c *htmlTextConverter) list(n *htmlNode) string {
+	number := 1
+	if start, err := strconv.Atoi(n.attr("start")); err == nil {
+		number = start
+	}
+	var items []string
+	for _, child := range n.children {
+		if child.kind != htmlElement || child.tag != "li" {
+			if child.kind == htmlElement && (child.tag == "ul" || child.tag == "ol") {
+				items = append(items, prefixLines(c.list(child), "  ", "  "))
+			}
+			continue
+		}
+		marker := "* "
+		if n.tag == "ol" {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		text := c.blocks(child, "\n")
+		items = append(items, prefixLines(text, marker, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+// table renders a data table in aligned columns. Tables that contain block
+// content, a single column or role="presentation" are layout tables, whose
+// cells are rendered one after another.
+func (c *htmlTextConverter) table(n *htmlNode) string {
+	var rows [][]*htmlNode
+	var walk func(*htmlNode)
+	walk = func(n *htmlNode) {
+		for _, child := range n.children {
+			if child.kind != htmlElement {
+				continue
+			}
+			switch child.tag {
+			case "thead", "tbody", "tfoot":
+				walk(child)
+			case "tr":
+				var cells []*htmlNode
+				for _, cell := range child.children {
+					if cell.kind == htmlElement && (cell.tag == "td" || cell.tag == "th") {
+						cells = append(cells, cell)
+					}
+				}
+				rows = append(rows, cells)
+			}
+		}
+	}
+	walk(n)
+
+	layout := n.attr("role") == "presentation"
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+		for _, cell := range row {
+			layout = layout || hasBlockContent(cell)
+		}
+	}
+	if layout || columns < 2 {
+		var parts []string
+		for _, row := range rows {
+			for _, cell := range row {
+				if text := c.blocks(cell, "\n\n"); strings.TrimSpace(text) != "" {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n\n")
+	}
+
+	cells := make([][]string, len(rows))
+	widths := make([]int, columns)
+	for r, row := range rows {
+		for i, cell := range row {
+			text := strings.ReplaceAll(collapseWhitespace(c.inlineChildren(cell)), "\n", " ")
+			cells[r] = append(cells[r], text)
+			widths[i] = max(widths[i], utf8.RuneCountInString(text))
+		}
+	}
+	var lines []string
+	for r, row := range cells {
+		var line strings.Builder
+		for i, text := range row {
+			if i > 0 {
+				line.WriteString(" | ")
+			}
+			line.WriteString(text + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(text)))
+		}
+		lines = append(lines, strings.TrimRight(line.String(), " "))
+		if r == 0 && len(rows[0]) > 0 && rows[0][0].tag == "th" {
+			var rule []string
+			for _, w := range widths {
+				rule = append(rule, strings.Repeat("-", w))
+			}
+			lines = append(lines, strings.Join(rule, "-+-"))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hasBlockContent reports whether a table cell contains block elements
+// other than line breaks, which marks the table as a layout table.
+func hasBlockContent(n *htmlNode) bool {
+	for _, child := range n.children {
+		if child.kind == htmlElement && (htmlBlockElements[child.tag] || hasBlockContent(child)) {
+			return true
+		}
+	}
+	return false
+}
+
+// collapseWhitespace collapses runs of whitespace to single spaces, as a
+// browser does, and turns line break markers into newlines.
+func collapseWhitespace(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	lines := strings.Split(s, lineBreak)
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+// prefixLines prefixes the first line of text with first and the others
+// with rest. Empty lines only get the trimmed prefix.
+func prefixLines(text, first, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if line == "" {
+			prefix = strings.TrimRight(prefix, " ")
+		}
+		lines[i] = prefix + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+func maxLineWidth(text string) int {
+	width := 0
+	for _, line := range strings.Split(text, "\n") {
+		width = max(width, utf8.RuneCountInString(line))
+	}
+	return width
+}
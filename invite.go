@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// calendarInvite is an iCalendar object (RFC 5545) to be sent as an
+// iTIP invitation or cancellation (RFC 5546, RFC 6047).
+type calendarInvite struct {
+	method  string
+	ics     string
+	summary string
+	text    string // default plain text body
+}
+
+// eventTimeLayouts are the accepted --event-start/--event-end formats;
+// those without a zone are in local time.
+var eventTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// loadInvite returns the calendar object for --invite, read from
+// --invite-file or generated from the --event-* options. It returns nil if no
+// invitation was requested.
+func loadInvite(config *Config) (*calendarInvite, error) {
+	if !config.Invite && config.InviteFile == "" {
+		return nil, nil
+	}
+	method := strings.ToUpper(config.InviteMethod)
+	if method != "REQUEST" && method != "CANCEL" {
+		return nil, fmt.Errorf("unsupported --invite-method %q, use REQUEST or CANCEL", config.InviteMethod)
+	}
+	if config.InviteFile != "" {
+		return readInviteFile(config.InviteFile, method)
+	}
+	return generateInvite(config, method)
+}
+
+// readInviteFile loads an existing .ics file. Its METHOD property is used if
+// present and otherwise added.
+func readInviteFile(filename, method string) (*calendarInvite, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ics := normalizeCRLF(string(data))
+	if !strings.HasPrefix(strings.ToUpper(ics), "BEGIN:VCALENDAR\r\n") {
+		return nil, fmt.Errorf("%s is not an iCalendar file", filename)
+	}
+	if !strings.HasSuffix(ics, "\r\n") {
+		ics += "\r\n"
+	}
+
+	invite := &calendarInvite{ics: ics}
+	for _, line := range strings.Split(strings.ReplaceAll(ics, "\r\n ", ""), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		name, _, _ = strings.Cut(strings.ToUpper(name), ";")
+		switch {
+		case name == "METHOD" && invite.method == "":
+			invite.method = strings.ToUpper(value)
+		case name == "SUMMARY" && invite.summary == "":
+			invite.summary = unescapeICSText(value)
+		}
+	}
+	if invite.method == "" {
+		invite.method = method
+		invite.ics = ics[:len("BEGIN:VCALENDAR\r\n")] + "METHOD:" + method + "\r\n" + ics[len("BEGIN:VCALENDAR\r\n"):]
+	}
+	invite.text = invite.summary
+	return invite, nil
+}
+
+// generateInvite builds a VEVENT from the --event-* options. The organizer
+// is --from and the attendees are the To (required) and Cc (optional)
+// recipients. Unless --event-uid is given, the UID is derived from the
+// organizer, start time and summary, so that a CANCEL sent with the same
+// options refers to the original event.
+func generateInvite(config *Config, method string) (*calendarInvite, error) {
+	if config.From == "" {
+		return nil, fmt.Errorf("--invite requires --from as the organizer")
+	}
+	if config.EventStart == "" {
+		return nil, fmt.Errorf("--invite requires --event-start or --invite-file")
+	}
+	start, allDay, err := parseEventTime(config.EventStart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --event-start: %w", err)
+	}
+	end := start.Add(time.Hour)
+	if allDay {
+		end = start.AddDate(0, 0, 1)
+	}
+	if config.EventEnd != "" {
+		var endAllDay bool
+		if end, endAllDay, err = parseEventTime(config.EventEnd); err != nil {
+			return nil, fmt.Errorf("invalid --event-end: %w", err)
+		}
+		if endAllDay != allDay {
+			return nil, fmt.Errorf("--event-start and --event-end must both be dates or both be date-times")
+		}
+		if allDay {
+			// --event-end names the last day, DTEND is exclusive
+			end = end.AddDate(0, 0, 1)
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("--event-end must be after --event-start")
+		}
+	}
+
+	organizer, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid From address %q: %w", config.From, err)
+	}
+
+	uid := config.EventUID
+	if uid == "" {
+		sum := sha256.Sum256([]byte(organizer.Address + "\x00" + config.EventStart + "\x00" + config.EventSummary))
+		uid = hex.EncodeToString(sum[:16]) + "@" + getHostname()
+	}
+	sequence := config.EventSequence
+	if sequence < 0 {
+		// A cancellation must not have a lower sequence than the event
+		sequence = 0
+		if method == "CANCEL" {
+			sequence = 1
+		}
+	}
+
+	var lines []string
+	add := func(line string) { lines = append(lines, line) }
+	add("BEGIN:VCALENDAR")
+	add("PRODID:-//smtp-cli//smtp-cli " + version + "//EN")
+	add("VERSION:2.0")
+	add("CALSCALE:GREGORIAN")
+	add("METHOD:" + method)
+	add("BEGIN:VEVENT")
+	add("UID:" + uid)
+	add("DTSTAMP:" + time.Now().UTC().Format("20060102T150405Z"))
+	if allDay {
+		add("DTSTART;VALUE=DATE:" + start.Format("20060102"))
+		add("DTEND;VALUE=DATE:" + end.Format("20060102"))
+	} else {
+		add("DTSTART:" + start.UTC().Format("20060102T150405Z"))
+		add("DTEND:" + end.UTC().Format("20060102T150405Z"))
+	}
+	add(fmt.Sprintf("SEQUENCE:%d", sequence))
+	if config.EventSummary != "" {
+		add("SUMMARY:" + escapeICSText(config.EventSummary))
+	}
+	if config.EventLocation != "" {
+		add("LOCATION:" + escapeICSText(config.EventLocation))
+	}
+	add("ORGANIZER" + icsNameParam(organizer.Name) + ":mailto:" + organizer.Address)
+	for _, list := range []struct {
+		role  string
+		addrs []string
+	}{
+		{"REQ-PARTICIPANT", config.To},
+		{"OPT-PARTICIPANT", config.Cc},
+	} {
+		for _, a := range list.addrs {
+			addr, err := mail.ParseAddress(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid attendee %q: %w", a, err)
+			}
+			add("ATTENDEE" + icsNameParam(addr.Name) + ";ROLE=" + list.role +
+				";PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:" + addr.Address)
+		}
+	}
+	if method == "CANCEL" {
+		add("STATUS:CANCELLED")
+	} else {
+		add("STATUS:CONFIRMED")
+	}
+	add("END:VEVENT")
+	add("END:VCALENDAR")
+
+	var ics strings.Builder
+	for _, line := range lines {
+		ics.WriteString(foldICSLine(line))
+	}
+
+	// Plain text version of the event for clients without calendar support
+	var text strings.Builder
+	if method == "CANCEL" {
+		text.WriteString("This event has been cancelled.\r\n\r\n")
+	}
+	if config.EventSummary != "" {
+		text.WriteString(config.EventSummary + "\r\n\r\n")
+	}
+	if allDay {
+		text.WriteString("When: " + start.Format("Mon, 02 Jan 2006"))
+		if last := end.AddDate(0, 0, -1); !last.Equal(start) {
+			text.WriteString(" - " + last.Format("Mon, 02 Jan 2006"))
+		}
+		text.WriteString("\r\n")
+	} else {
+		end = end.In(start.Location())
+		endLayout := "15:04 MST"
+		if end.YearDay() != start.YearDay() || end.Year() != start.Year() {
+			endLayout = "Mon, 02 Jan 2006 15:04 MST"
+		}
+		text.WriteString("When: " + start.Format("Mon, 02 Jan 2006 15:04 MST") + " - " + end.Format(endLayout) + "\r\n")
+	}
+	if config.EventLocation != "" {
+		text.WriteString("Where: " + config.EventLocation + "\r\n")
+	}
+	// The body is not a header, so the name is written as is
+	organizerText := organizer.Address
+	if organizer.Name != "" {
+		organizerText = organizer.Name + " <" + organizer.Address + ">"
+	}
+	text.WriteString("Organizer: " + organizerText + "\r\n")
+
+	return &calendarInvite{method: method, ics: ics.String(), summary: config.EventSummary, text: text.String()}, nil
+}
+
+// parseEventTime parses an --event-start or --event-end value. A plain date
+// (2006-01-02) denotes an all-day event.
+func parseEventTime(s string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, true, nil
+	}
+	for _, layout := range eventTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, false, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("%q is not a date (2006-01-02) or time (2006-01-02 15:04 or RFC 3339)", s)
+}
+
+// inviteSubject returns the default subject for an invitation.
+func inviteSubject(invite *calendarInvite) string {
+	if invite.summary == "" {
+		return ""
+	}
+	if invite.method == "CANCEL" {
+		return "Cancelled: " + invite.summary
+	}
+	return "Invitation: " + invite.summary
+}
+
+// calendarPart returns a writer for the text/calendar alternative that
+// calendar clients show as an invitation. The ICS is always UTF-8, so it is
+// sent quoted-printable if it isn't plain ASCII and --text-encoding would
+// leave it unencoded.
+func calendarPart(config *Config, invite *calendarInvite) partWriter {
+	encoding := config.TextEncoding
+	if encoding != "base64" && encoding != "quoted-printable" && !isASCII(invite.ics) {
+		encoding = "quoted-printable"
+	}
+	return func(buf *strings.Builder) error {
+		buf.WriteString(fmt.Sprintf("Content-Type: text/calendar; charset=\"UTF-8\"; method=%s\r\n", invite.method))
+		buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n\r\n", encoding))
+		buf.WriteString(encodeBody(invite.ics, encoding))
+		return nil
+	}
+}
+
+// calendarAttachmentPart returns a writer for the invite.ics attachment,
+// which some clients need to offer the event for import.
+func calendarAttachmentPart(invite *calendarInvite) partWriter {
+	return func(buf *strings.Builder) error {
+		buf.WriteString("Content-Type: application/ics; name=\"invite.ics\"\r\n")
+		buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+		buf.WriteString("Content-Disposition: attachment; filename=\"invite.ics\"\r\n\r\n")
+		buf.WriteString(wrapBase64([]byte(invite.ics)))
+		return nil
+	}
+}
+
+// escapeICSText escapes a TEXT property value (RFC 5545 section 3.3.11).
+func escapeICSText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// unescapeICSText reverses escapeICSText.
+func unescapeICSText(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// icsNameParam returns the CN parameter for a display name. Parameter
+// values cannot contain DQUOTE, so any are dropped.
+func icsNameParam(name string) string {
+	if name == "" {
+		return ""
+	}
+	return `;CN="` + strings.ReplaceAll(name, `"`, "") + `"`
+}
+
+// foldICSLine folds a content line to at most 75 octets per line without
+// splitting UTF-8 sequences (RFC 5545 section 3.1) and terminates it.
+func foldICSLine(line string) string {
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+	return b.String()
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// singleHeaders may appear at most once in a message (RFC 5322 section 3.6).
+var singleHeaders = []string{
+	"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc",
+	"Message-Id", "In-Reply-To", "References", "Subject",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// linter collects the problems found in a message.
+type linter struct {
+	out      io.Writer
+	lines    []string
+	errors   int
+	warnings int
+}
+
+func (l *linter) errorf(line int, format string, args ...any) {
+	l.errors++
+	l.report("error", line, format, args...)
+}
+
+func (l *linter) warnf(line int, format string, args ...any) {
+	l.warnings++
+	l.report("warning", line, format, args...)
+}
+
+func (l *linter) report(level string, line int, format string, args ...any) {
+	if line > 0 {
+		fmt.Fprintf(l.out, "%s: line %d: %s\n", level, line, fmt.Sprintf(format, args...))
+	} else {
+		fmt.Fprintf(l.out, "%s: %s\n", level, fmt.Sprintf(format, args...))
+	}
+}
+
+// lintField is an unfolded header field and the line it starts on.
+type lintField struct {
+	name  string
+	value string
+	raw   string
+	line  int
+}
+
+// runLint implements "smtp-cli lint [options] file...". It returns the
+// process exit status: 0 if no errors were found, 1 otherwise and 2 if the
+// input could not be read.
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	dkimKey := fs.String("dkim-pubkey", "", "Verify DKIM signatures with this public key (PEM, or a DNS TXT record \"v=DKIM1; p=...\")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s lint [options] <file.eml|->...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var pub crypto.PublicKey
+	if *dkimKey != "" {
+		var err error
+		if pub, err = loadDKIMPublicKey(*dkimKey); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load DKIM public key: %v\n", err)
+			return 2
+		}
+	}
+
+	status := 0
+	for _, filename := range fs.Args() {
+		var data []byte
+		var err error
+		if filename == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(filename)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if fs.NArg() > 1 {
+			fmt.Printf("%s:\n", filename)
+		}
+		l := &linter{out: os.Stdout}
+		l.lintMessage(string(data), pub)
+		fmt.Printf("%d error(s), %d warning(s)\n", l.errors, l.warnings)
+		if l.errors > 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// lintMessage checks a complete message.
+func (l *linter) lintMessage(data string, pub crypto.PublicKey) {
+	bareLF := 0
+	newlines := strings.Count(data, "\n")
+	for i, line := range strings.Split(data, "\n") {
+		if i == newlines && line == "" {
+			break
+		}
+		if strings.HasSuffix(line, "\r") {
+			line = line[:len(line)-1]
+		} else if i < newlines {
+			bareLF++
+		}
+		if strings.Contains(line, "\r") {
+			l.errorf(i+1, "bare CR in line")
+		}
+		l.lines = append(l.lines, line)
+	}
+	if bareLF > 0 {
+		l.warnf(0, "%d line(s) end in a bare LF instead of CRLF", bareLF)
+	}
+
+	for i, line := range l.lines {
+		if len(line) > 998 {
+			l.errorf(i+1, "line is %d characters long, the limit is 998", len(line))
+		}
+	}
+
+	fields, bodyStart := l.lintHeaders(0, true)
+	l.lintMessageHeaders(fields)
+	l.lintEntity(fields, bodyStart, len(l.lines), "")
+
+	l.lintDKIM(normalizeCRLF(data), pub)
+}
+
+// lintHeaders parses and checks the header block starting at line index
+// start. It returns the fields and the index of the first body line.
+func (l *linter) lintHeaders(start int, top bool) ([]lintField, int) {
+	var fields []lintField
+	i := start
+	for ; i < len(l.lines); i++ {
+		line := l.lines[i]
+		if line == "" {
+			return fields, i + 1
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) == 0 {
+				l.errorf(i+1, "continuation line without a header field")
+				continue
+			}
+			f := &fields[len(fields)-1]
+			f.value += line
+			f.raw += "\r\n" + line
+			if strings.TrimSpace(line) == "" {
+				l.warnf(i+1, "whitespace-only continuation line in %s", f.name)
+			}
+		} else {
+			name, value, ok := strings.Cut(line, ":")
+			if !ok || !validFieldName(name) {
+				if top && len(fields) > 0 && !ok {
+					l.errorf(i+1, "header field without colon; missing blank line between header and body?")
+				} else {
+					l.errorf(i+1, "invalid header field %q", line[:min(len(line), 40)])
+				}
+				continue
+			}
+			fields = append(fields, lintField{name: name, value: value, raw: line, line: i + 1})
+		}
+		if len(line) > 78 {
+			l.warnf(i+1, "header line is %d characters long, it should be folded at 78", len(line))
+		}
+	}
+	if top {
+		l.errorf(0, "no blank line separating header and body")
+	}
+	return fields, i
+}
+
+// lintMessageHeaders applies the checks that only make sense for the
+// top-level message header.
+func (l *linter) lintMessageHeaders(fields []lintField) {
+	count := make(map[string]int)
+	seenOther := false
+	for _, f := range fields {
+		name := textproto.CanonicalMIMEHeaderKey(f.name)
+		count[name]++
+
+		switch name {
+		case "Received", "Return-Path":
+			if seenOther {
+				l.warnf(f.line, "trace field %s after other header fields", f.name)
+			}
+		case "Dkim-Signature":
+		default:
+			seenOther = true
+		}
+
+		if !isPrintableASCII(strings.ReplaceAll(f.value, "\t", " ")) {
+			l.errorf(f.line, "unencoded non-ASCII characters in %s header (use RFC 2047 encoding)", f.name)
+		} else if strings.Contains(f.value, "=?") {
+			if _, err := headerWordDecoder.DecodeHeader(f.value); err != nil {
+				l.warnf(f.line, "invalid RFC 2047 encoded-word in %s: %v", f.name, err)
+			}
+		}
+
+		switch {
+		case name == "Bcc":
+			l.errorf(f.line, "Bcc header present; it would reveal blind copy recipients")
+		case name == "Date":
+			if _, err := mail.ParseDate(strings.TrimSpace(f.value)); err != nil {
+				l.errorf(f.line, "invalid Date: %v", err)
+			}
+		case name == "Message-Id":
+			if !isMsgID(strings.Trim(strings.TrimSpace(f.value), "<>")) || !strings.HasPrefix(strings.TrimSpace(f.value), "<") {
+				l.errorf(f.line, "invalid Message-ID %q", strings.TrimSpace(f.value))
+			}
+		case addressHeaders[name]:
+			if _, err := mail.ParseAddressList(f.value); err != nil && strings.TrimSpace(f.value) != "" {
+				l.errorf(f.line, "invalid address list in %s: %v", f.name, err)
+			}
+		}
+	}
+
+	for _, name := range singleHeaders {
+		if count[name] > 1 {
+			l.errorf(0, "%s header appears %d times", name, count[name])
+		}
+	}
+	if count["From"] == 0 {
+		l.errorf(0, "missing From header")
+	}
+	if count["Date"] == 0 {
+		l.errorf(0, "missing Date header")
+	}
+	if count["Message-Id"] == 0 {
+		l.warnf(0, "missing Message-ID header")
+	}
+	if count["Mime-Version"] == 0 && (count["Content-Type"] > 0 || count["Content-Transfer-Encoding"] > 0) {
+		l.errorf(0, "MIME headers present but MIME-Version is missing")
+	}
+}
+
+// lintEntity checks the MIME structure and transfer encoding of the entity
+// whose body spans line indexes [start, end).
+func (l *linter) lintEntity(fields []lintField, start, end int, path string) {
+	label := "message body"
+	if path != "" {
+		label = "part " + path
+	}
+
+	contentType := "text/plain"
+	encoding := "7bit"
+	for _, f := range fields {
+		switch textproto.CanonicalMIMEHeaderKey(f.name) {
+		case "Content-Type":
+			contentType = strings.TrimSpace(f.value)
+		case "Content-Transfer-Encoding":
+			encoding = strings.ToLower(strings.TrimSpace(f.value))
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		l.errorf(0, "%s: invalid Content-Type %q: %v", label, contentType, err)
+		return
+	}
+
+	switch encoding {
+	case "7bit", "8bit", "binary", "quoted-printable", "base64":
+	default:
+		l.errorf(0, "%s: unknown Content-Transfer-Encoding %q", label, encoding)
+		return
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if encoding != "7bit" && encoding != "8bit" && encoding != "binary" {
+			l.errorf(0, "%s: multipart entities must not use %s encoding", label, encoding)
+		}
+		l.lintMultipart(params["boundary"], start, end, path, label)
+		return
+	}
+	if mediaType == "message/rfc822" {
+		fields, bodyStart := l.lintHeaders(start, false)
+		l.lintEntity(fields, bodyStart, end, path+".msg")
+		return
+	}
+
+	switch encoding {
+	case "7bit":
+		for i := start; i < end; i++ {
+			if !isPrintableASCII(strings.ReplaceAll(l.lines[i], "\t", " ")) {
+				l.errorf(i+1, "%s: 8-bit or control characters in 7bit content", label)
+				break
+			}
+		}
+	case "8bit":
+		for i := start; i < end; i++ {
+			if strings.ContainsRune(l.lines[i], 0) {
+				l.errorf(i+1, "%s: NUL character in 8bit content", label)
+				break
+			}
+		}
+	case "base64":
+		l.lintBase64(start, end, label)
+	case "quoted-printable":
+		l.lintQuotedPrintable(start, end, label)
+	}
+}
+
+// lintMultipart checks the delimiters of a multipart body and each part.
+func (l *linter) lintMultipart(boundary string, start, end int, path, label string) {
+	if boundary == "" {
+		l.errorf(0, "%s: multipart Content-Type without boundary parameter", label)
+		return
+	}
+	if len(boundary) > 70 {
+		l.errorf(0, "%s: boundary is longer than 70 characters", label)
+	}
+
+	var delimiters []int
+	closing := -1
+	for i := start; i < end; i++ {
+		line := strings.TrimRight(l.lines[i], " \t")
+		if line == "--"+boundary+"--" {
+			closing = i
+			break
+		}
+		if line == "--"+boundary {
+			delimiters = append(delimiters, i)
+		}
+	}
+	if len(delimiters) == 0 {
+		l.errorf(0, "%s: no parts found for boundary %q", label, boundary)
+		return
+	}
+	if closing < 0 {
+		l.errorf(0, "%s: closing boundary \"--%s--\" is missing", label, boundary)
+		closing = end
+	}
+
+	for n, first := range delimiters {
+		last := closing
+		if n+1 < len(delimiters) {
+			last = delimiters[n+1]
+		}
+		partPath := fmt.Sprintf("%d", n+1)
+		if path != "" {
+			partPath = path + "." + partPath
+		}
+		fields, bodyStart := l.lintHeaders(first+1, false)
+		if bodyStart > last {
+			l.errorf(first+1, "part %s: header runs into the next boundary", partPath)
+			continue
+		}
+		l.lintEntity(fields, bodyStart, last, partPath)
+	}
+}
+
+func (l *linter) lintBase64(start, end int, label string) {
+	var encoded strings.Builder
+	for i := start; i < end; i++ {
+		line := l.lines[i]
+		if len(line) > 76 {
+			l.warnf(i+1, "%s: base64 line is %d characters long, the limit is 76", label, len(line))
+		}
+		for _, c := range line {
+			if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '=') {
+				l.errorf(i+1, "%s: invalid character %q in base64 content", label, c)
+				return
+			}
+		}
+		encoded.WriteString(line)
+	}
+	if _, err := base64.StdEncoding.DecodeString(encoded.String()); err != nil {
+		l.errorf(0, "%s: invalid base64 content: %v", label, err)
+	}
+}
+
+func (l *linter) lintQuotedPrintable(start, end int, label string) {
+	for i := start; i < end; i++ {
+		line := l.lines[i]
+		if len(line) > 76 {
+			l.errorf(i+1, "%s: quoted-printable line is %d characters long, the limit is 76", label, len(line))
+		}
+		if strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") {
+			l.errorf(i+1, "%s: unencoded trailing whitespace in quoted-printable content", label)
+		}
+		for j := 0; j < len(line); j++ {
+			c := line[j]
+			switch {
+			case c == '=':
+				if j == len(line)-1 {
+					break // soft line break
+				}
+				if j+2 >= len(line) || !isHex(line[j+1]) || !isHex(line[j+2]) {
+					l.errorf(i+1, "%s: invalid quoted-printable escape %q", label, line[j:min(j+3, len(line))])
+					return
+				}
+				j += 2
+			case c == '\t' || c >= 32 && c <= 126:
+			default:
+				l.errorf(i+1, "%s: unencoded byte 0x%02X in quoted-printable content", label, c)
+				return
+			}
+		}
+	}
+}
+
+// lintDKIM verifies every DKIM-Signature header in message with pub.
+func (l *linter) lintDKIM(message string, pub crypto.PublicKey) {
+	header, _ := splitMessage(message)
+	fields := parseHeaderFields(header)
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		if pub == nil {
+			l.warnf(0, "DKIM signature not verified: no --dkim-pubkey given")
+			continue
+		}
+		if err := verifyDKIM(message, f, pub); err != nil {
+			l.errorf(0, "DKIM signature invalid: %v", err)
+		} else {
+			fmt.Fprintln(l.out, "ok: DKIM signature verified")
+		}
+	}
+}
+
+// loadDKIMPublicKey reads a DKIM public key from a PEM file (public or
+// private key) or from a file holding the DNS TXT record.
+func loadDKIMPublicKey(filename string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		switch block.Type {
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		}
+		key, err := loadPrivateKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public(), nil
+	}
+
+	tags := parseDKIMTags(strings.Trim(strings.TrimSpace(string(data)), "\""))
+	p, ok := tags["p"]
+	if !ok {
+		return nil, fmt.Errorf("%s: no PEM key or p= tag found", filename)
+	}
+	raw, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid p= tag: %w", filename, err)
+	}
+	if tags["k"] == "ed25519" {
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: invalid Ed25519 key length", filename)
+		}
+		return ed25519.PublicKey(raw), nil
+	}
+	if key, err := x509.ParsePKIXPublicKey(raw); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS1PublicKey(raw)
+}
+
+// verifyDKIM checks one DKIM-Signature field against message.
+func verifyDKIM(message string, sig headerField, pub crypto.PublicKey) error {
+	_, value, _ := strings.Cut(sig.raw, ":")
+	tags := parseDKIMTags(value)
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[tag]; !ok {
+			return fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		headerCanon, bodyCanon, _ = strings.Cut(c, "/")
+		if bodyCanon == "" {
+			bodyCanon = "simple"
+		}
+	}
+
+	var hashAlgo crypto.Hash
+	switch tags["a"] {
+	case "rsa-sha256", "ed25519-sha256":
+		hashAlgo = crypto.SHA256
+	case "rsa-sha1":
+		hashAlgo = crypto.SHA1
+	default:
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+
+	header, body := splitMessage(message)
+	switch bodyCanon {
+	case "relaxed":
+		body = relaxedBody(body)
+	case "simple":
+		body = simpleBody(body)
+	default:
+		return fmt.Errorf("unknown body canonicalization %q", bodyCanon)
+	}
+	if lengthTag, ok := tags["l"]; ok {
+		var n int
+		if _, err := fmt.Sscanf(lengthTag, "%d", &n); err != nil || n > len(body) {
+			return fmt.Errorf("invalid l= tag %q", lengthTag)
+		}
+		body = body[:n]
+	}
+	h := hashAlgo.New()
+	h.Write([]byte(body))
+	if got := base64.StdEncoding.EncodeToString(h.Sum(nil)); got != tags["bh"] {
+		return fmt.Errorf("body hash mismatch (body was modified)")
+	}
+
+	canon := func(raw string) string {
+		if headerCanon == "relaxed" {
+			return relaxedHeader(raw)
+		}
+		return raw
+	}
+	if headerCanon != "relaxed" && headerCanon != "simple" {
+		return fmt.Errorf("unknown header canonicalization %q", headerCanon)
+	}
+
+	fields := parseHeaderFields(header)
+	used := make(map[int]bool)
+	h = hashAlgo.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				h.Write([]byte(canon(fields[i].raw) + "\r\n"))
+				break
+			}
+		}
+	}
+	h.Write([]byte(canon(stripDKIMSignatureValue(sig.raw))))
+	digest := h.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid b= tag: %w", err)
+	}
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(tags["a"], "rsa-") {
+			return fmt.Errorf("algorithm %q does not match RSA key", tags["a"])
+		}
+		if err := rsa.VerifyPKCS1v15(key, hashAlgo, digest, signature); err != nil {
+			return fmt.Errorf("signature mismatch (headers were modified or wrong key)")
+		}
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return fmt.Errorf("algorithm %q does not match Ed25519 key", tags["a"])
+		}
+		if !ed25519.Verify(key, digest, signature) {
+			return fmt.Errorf("signature mismatch (headers were modified or wrong key)")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil
+}
+
+// parseDKIMTags parses a DKIM tag=value list, removing all whitespace from
+// the values.
+func parseDKIMTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+// stripDKIMSignatureValue empties the b= tag of a DKIM-Signature field, as
+// required when hashing the field itself.
+func stripDKIMSignatureValue(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(tag) == "b" {
+			specs[i] = spec[:strings.Index(spec, "=")+1]
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
+
+// simpleBody applies the "simple" body canonicalization.
+func simpleBody(body string) string {
+	for strings.HasSuffix(body, "\r\n\r\n") {
+		body = body[:len(body)-2]
+	}
+	if body == "\r\n" || body == "" {
+		return "\r\n"
+	}
+	if !strings.HasSuffix(body, "\r\n") {
+		body += "\r\n"
+	}
+	return body
+}
+
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F' || c >= 'a' && c <= 'f'
+}
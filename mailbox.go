@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// batchMessage is one message of a batch: either a file to read, or a
+// message taken from a mailbox together with a name for reporting.
+type batchMessage struct {
+	name string
+	data []byte
+}
+
+// readMbox splits an mbox file into its messages. A message starts at a
+// "From " line at the beginning of the file or after an empty line; the
+// From_ line itself is dropped, as is the empty line that separates it from
+// the previous message. Quoted ">From " lines are unescaped following the
+// mboxrd convention.
+func readMbox(filename string) ([]batchMessage, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no messages in %s", filename)
+	}
+	if !bytes.HasPrefix(data, []byte("From ")) {
+		return nil, fmt.Errorf("%s is not an mbox file", filename)
+	}
+
+	var messages []batchMessage
+	var current *bytes.Buffer
+	flush := func() {
+		if current == nil {
+			return
+		}
+		msg := current.Bytes()
+		// The empty line before the next From_ line is a separator
+		if bytes.HasSuffix(msg, []byte("\n\n")) {
+			msg = msg[:len(msg)-1]
+		}
+		messages = append(messages, batchMessage{
+			name: fmt.Sprintf("%s#%d", filename, len(messages)+1),
+			data: msg,
+		})
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(line, []byte("From ")) && (i == 0 || string(lines[i-1]) == "\n") {
+			flush()
+			current = &bytes.Buffer{}
+			continue
+		}
+		if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+			line = line[1:]
+		}
+		current.Write(line)
+	}
+	flush()
+
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("no messages in %s", filename)
+	}
+	return messages, nil
+}
+
+// readMaildir returns the messages in the cur and new subdirectories of a
+// Maildir, ordered by file name, which starts with the delivery time.
+// Messages still being delivered to tmp are skipped.
+func readMaildir(dir string) ([]batchMessage, error) {
+	var files []string
+	found := false
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, e := range entries {
+			if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(dir, sub, e.Name()))
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not a Maildir (no cur or new directory)", dir)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no messages in %s", dir)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+
+	messages := make([]batchMessage, len(files))
+	for i, f := range files {
+		messages[i] = batchMessage{name: f}
+	}
+	return messages, nil
+}
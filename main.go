@@ -1,23 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"mime"
+	"mime/quotedprintable"
 	"net"
 	"net/mail"
 	"net/textproto"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type Config struct {
@@ -47,28 +56,92 @@ type Config struct {
 	Auth         bool
 
 	// Sender/Recipients
-	From string
-	To   []string
-	Cc   []string
-	Bcc  []string
+	From    string
+	To      []string
+	Cc      []string
+	Bcc     []string
+	ReplyTo []string
 
 	// Envelope
-	MailFrom string
-	RcptTo   []string
+	MailFrom            string
+	RcptTo              []string
+	EnvelopeFromHeaders bool
 
 	// Message content
 	Data         string
+	DataFiles    []string
+	DataContent  []byte
+	Mbox         string
+	Maildir      string
 	Subject      string
 	BodyPlain    string
 	BodyHTML     string
+	BodyMarkdown string
+	AutoText     bool
+	CleanHTML    bool
 	Charset      string
+	InputCharset string
 	TextEncoding string
 	Attach       []string
 	AttachInline []string
+	Forward      []string
+	Bounce       string
+	Reply        string
+	InReplyTo    string
+	References   []string
+	MimeTypes    string
+	EmbedImages  bool
 	AddHeader    []string
 	ReplaceHeader []string
 	RemoveHeader []string
 
+	// Calendar invitations
+	Invite        bool
+	InviteMethod  string
+	InviteFile    string
+	EventStart    string
+	EventEnd      string
+	EventSummary  string
+	EventLocation string
+	EventUID      string
+	EventSequence int
+
+	// Templates
+	Template bool
+	Vars     []string
+	VarsFile string
+	MergeRow map[string]any
+
+	// Mail merge
+	MergeFile    string
+	MergeResults string
+
+	// Bulk sending
+	Concurrency      int
+	Rate             float64
+	MaxPerConnection int
+
+	// Queue
+	QueueDir        string
+	QueueExpireDays int
+	QueueInterval   int
+
+	// DKIM signing
+	DKIMKey      string
+	DKIMSelector string
+	DKIMDomain   string
+	DKIMHeaders  string
+
+	// S/MIME
+	SMIMESignCert    string
+	SMIMESignKey     string
+	SMIMEEncryptCert []string
+
+	// PGP/MIME
+	PGPSignKey    string
+	PGPPassphrase string
+	PGPEncryptKey []string
+
 	// Other
 	Verbose         int
 	PrintOnly       bool
@@ -88,7 +161,20 @@ type SMTPClient struct {
 const version = "3.10"
 
 func main() {
-	config := parseFlags()
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(runLint(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		os.Exit(runQueue(os.Args[2:]))
+	}
+	if filepath.Base(os.Args[0]) == "sendmail" {
+		os.Exit(runSendmail(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "--sendmail" {
+		os.Exit(runSendmail(os.Args[2:]))
+	}
+
+	config := parseFlags(os.Args[1:])
 
 	if config.Version {
 		fmt.Printf("smtp-cli version %s\n", version)
@@ -105,7 +191,7 @@ func main() {
 	}
 }
 
-func parseFlags() *Config {
+func parseFlags(args []string) *Config {
 	config := &Config{}
 
 	// Connection flags
@@ -137,39 +223,26 @@ func parseFlags() *Config {
 
 	// Sender/Recipients flags
 	flag.StringVar(&config.From, "from", "", "Sender's name address (or address only)")
-	flag.Func("to", "Message recipients", func(s string) error {
-		// Handle comma-separated addresses
-		addresses := strings.Split(s, ",")
-		for _, addr := range addresses {
-			addr = strings.TrimSpace(addr)
-			if addr != "" {
-				config.To = append(config.To, addr)
-			}
-		}
-		return nil
-	})
-	flag.Func("cc", "Message recipients (CC)", func(s string) error {
-		// Handle comma-separated addresses
-		addresses := strings.Split(s, ",")
-		for _, addr := range addresses {
-			addr = strings.TrimSpace(addr)
-			if addr != "" {
-				config.Cc = append(config.Cc, addr)
-			}
-		}
-		return nil
-	})
-	flag.Func("bcc", "Message recipients (BCC)", func(s string) error {
-		// Handle comma-separated addresses
-		addresses := strings.Split(s, ",")
-		for _, addr := range addresses {
-			addr = strings.TrimSpace(addr)
-			if addr != "" {
-				config.Bcc = append(config.Bcc, addr)
-			}
-		}
-		return nil
-	})
+	// Address lists are parsed once --input-charset is known
+	type addressFlag struct {
+		name, value string
+		list        *[]string
+	}
+	var addressFlags []addressFlag
+	for _, f := range []struct {
+		name, usage string
+		list        *[]string
+	}{
+		{"to", "Message recipients", &config.To},
+		{"cc", "Message recipients (CC)", &config.Cc},
+		{"bcc", "Message recipients (BCC)", &config.Bcc},
+		{"reply-to", "Address(es) replies should be sent to", &config.ReplyTo},
+	} {
+		flag.Func(f.name, f.usage, func(s string) error {
+			addressFlags = append(addressFlags, addressFlag{f.name, s, f.list})
+			return nil
+		})
+	}
 
 	// Envelope flags
 	flag.StringVar(&config.MailFrom, "mail-from", "", "Address to use in MAIL FROM command")
@@ -177,13 +250,23 @@ func parseFlags() *Config {
 		config.RcptTo = append(config.RcptTo, s)
 		return nil
 	})
+	flag.BoolVar(&config.EnvelopeFromHeaders, "envelope-from-headers", false, "Take MAIL FROM and RCPT TO from the headers of the --data message")
 
 	// Message content flags
-	flag.StringVar(&config.Data, "data", "", "Name of file to send after DATA command")
+	flag.Func("data", "Name of file to send after DATA command (repeat, or give a directory or glob, to send several)", func(s string) error {
+		config.DataFiles = append(config.DataFiles, s)
+		return nil
+	})
+	flag.StringVar(&config.Mbox, "mbox", "", "Send every message in this mbox file")
+	flag.StringVar(&config.Maildir, "maildir", "", "Send every message in this Maildir directory")
 	flag.StringVar(&config.Subject, "subject", "", "Subject of the message")
 	flag.StringVar(&config.BodyPlain, "body-plain", "", "Plaintext body of the message")
 	flag.StringVar(&config.BodyHTML, "body-html", "", "HTML body of the message")
+	flag.StringVar(&config.BodyMarkdown, "body-markdown", "", "Markdown body, sent as HTML with the source as the plain text alternative")
+	flag.BoolVar(&config.CleanHTML, "clean-html", false, "Inline <style> rules and remove scripts and forms from the HTML body")
+	flag.BoolVar(&config.AutoText, "auto-text", false, "Generate the plain text alternative from the HTML body")
 	flag.StringVar(&config.Charset, "charset", "UTF-8", "Character set used for Subject and Body")
+	flag.StringVar(&config.InputCharset, "input-charset", "UTF-8", "Character set of the Subject, Body and header options, converted to --charset")
 	flag.StringVar(&config.TextEncoding, "text-encoding", "quoted-printable", "Content-Transfer-Encoding for text parts")
 	flag.Func("attach", "Attach a given filename", func(s string) error {
 		config.Attach = append(config.Attach, s)
@@ -193,6 +276,46 @@ func parseFlags() *Config {
 		config.AttachInline = append(config.AttachInline, s)
 		return nil
 	})
+	flag.Func("forward", "Attach an existing message file as message/rfc822", func(s string) error {
+		config.Forward = append(config.Forward, s)
+		return nil
+	})
+	flag.StringVar(&config.Reply, "reply", "", "Reply to an existing message file, setting Subject, To, In-Reply-To and References")
+	flag.StringVar(&config.InReplyTo, "in-reply-to", "", "Message-ID of the message being replied to")
+	flag.Func("references", "Message-IDs of the thread the message belongs to", func(s string) error {
+		config.References = append(config.References, s)
+		return nil
+	})
+	flag.StringVar(&config.Bounce, "bounce", "", "Redirect an existing message file unchanged to --to/--cc/--bcc with Resent-* headers")
+	flag.BoolVar(&config.EmbedImages, "embed-images", false, "Embed local images referenced by <img src> in the HTML body as inline attachments")
+	flag.StringVar(&config.MimeTypes, "mime-types", "", "Load additional extension to MIME type mappings from a mime.types file")
+	flag.BoolVar(&config.Template, "template", false, "Render Subject and bodies as Go templates (implied by --var and --vars-file)")
+	flag.Func("var", "Set a template variable (key=value)", func(s string) error {
+		config.Vars = append(config.Vars, s)
+		return nil
+	})
+	flag.StringVar(&config.VarsFile, "vars-file", "", "Load template variables from a JSON or YAML file")
+	flag.StringVar(&config.MergeFile, "merge-file", "", "Send one templated message per row of this CSV or JSON recipient list")
+	flag.StringVar(&config.MergeResults, "merge-results", "", "Write per-row delivery status to this CSV file (default: <merge-file>.results.csv)")
+	flag.IntVar(&config.Concurrency, "concurrency", 1, "Number of parallel SMTP connections for batch and mail-merge sending")
+	flag.Float64Var(&config.Rate, "rate", 0, "Maximum messages per second across all connections (0 = unlimited)")
+	flag.IntVar(&config.MaxPerConnection, "max-per-connection", 0, "Reconnect after this many messages on one connection (0 = unlimited)")
+
+	// Calendar flags
+	flag.BoolVar(&config.Invite, "invite", false, "Send a calendar invitation built from the --event-* options")
+	flag.StringVar(&config.InviteMethod, "invite-method", "REQUEST", "iTIP method of the invitation: REQUEST or CANCEL")
+	flag.StringVar(&config.InviteFile, "invite-file", "", "Send this .ics file as the invitation instead of building one (implies --invite)")
+	flag.StringVar(&config.EventStart, "event-start", "", "Start of the event (2006-01-02 15:04, RFC 3339, or a date for all-day events)")
+	flag.StringVar(&config.EventEnd, "event-end", "", "End of the event (default: one hour, or one day, after the start)")
+	flag.StringVar(&config.EventSummary, "event-summary", "", "Title of the event")
+	flag.StringVar(&config.EventLocation, "event-location", "", "Location of the event")
+	flag.StringVar(&config.EventUID, "event-uid", "", "UID of the event, to update or cancel an earlier invitation")
+	flag.IntVar(&config.EventSequence, "event-sequence", -1, "Revision number of the event (default: 0, or 1 for CANCEL)")
+
+	// Queue flags
+	flag.StringVar(&config.QueueDir, "queue-dir", defaultQueueDir(), "Spool directory for the queue commands")
+	flag.IntVar(&config.QueueExpireDays, "queue-expire", 5, "Bounce queued messages that could not be delivered within this many days")
+	flag.IntVar(&config.QueueInterval, "queue-interval", 0, "Keep \"queue run\" running and check the queue every this many minutes")
 	flag.Func("add-header", "Add header", func(s string) error {
 		config.AddHeader = append(config.AddHeader, s)
 		return nil
@@ -206,6 +329,28 @@ func parseFlags() *Config {
 		return nil
 	})
 
+	// DKIM flags
+	flag.StringVar(&config.DKIMKey, "dkim-key", "", "Sign the message with DKIM using this PEM private key (RSA or Ed25519)")
+	flag.StringVar(&config.DKIMSelector, "dkim-selector", "", "DKIM selector (s= tag)")
+	flag.StringVar(&config.DKIMDomain, "dkim-domain", "", "DKIM signing domain (d= tag), defaults to the From domain")
+	flag.StringVar(&config.DKIMHeaders, "dkim-headers", "", "Colon-separated list of headers to sign with DKIM")
+
+	// S/MIME flags
+	flag.StringVar(&config.SMIMESignCert, "smime-sign-cert", "", "Sign the message with S/MIME using this PEM certificate (plus optional chain)")
+	flag.StringVar(&config.SMIMESignKey, "smime-sign-key", "", "PEM private key for --smime-sign-cert (default: read from the certificate file)")
+	flag.Func("smime-encrypt-cert", "Encrypt the message with S/MIME for the recipient in this PEM certificate file", func(s string) error {
+		config.SMIMEEncryptCert = append(config.SMIMEEncryptCert, s)
+		return nil
+	})
+
+	// PGP/MIME flags
+	flag.StringVar(&config.PGPSignKey, "pgp-sign-key", "", "Sign the message with PGP/MIME using the secret key in this armored key file")
+	flag.StringVar(&config.PGPPassphrase, "pgp-passphrase", "", "Passphrase for a protected --pgp-sign-key")
+	flag.Func("pgp-encrypt-key", "Encrypt the message with PGP/MIME to the public key(s) in this armored key file", func(s string) error {
+		config.PGPEncryptKey = append(config.PGPEncryptKey, s)
+		return nil
+	})
+
 	// Other flags
 	flag.IntVar(&config.Verbose, "verbose", 0, "Be more verbose, print the SMTP session")
 	flag.BoolVar(&config.PrintOnly, "print-only", false, "Dump the composed MIME message to standard output")
@@ -213,7 +358,35 @@ func parseFlags() *Config {
 	flag.BoolVar(&config.Version, "version", false, "Print version")
 	flag.BoolVar(&config.Help, "help", false, "Show help")
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+
+	for _, f := range addressFlags {
+		s, err := decodeUTF8Input(config, f.value)
+		if err == nil {
+			err = appendAddresses(f.list, s)
+		}
+		if err != nil {
+			flagValueError(f.name, f.value, err)
+		}
+	}
+	from, err := decodeUTF8Input(config, config.From)
+	if err != nil {
+		flagValueError("from", config.From, err)
+	}
+	config.From = from
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"event-summary", &config.EventSummary},
+		{"event-location", &config.EventLocation},
+	} {
+		s, err := decodeUTF8Input(config, *f.value)
+		if err != nil {
+			flagValueError(f.name, *f.value, err)
+		}
+		*f.value = s
+	}
 
 	// Handle server:port format
 	if strings.Contains(config.Server, ":") {
@@ -235,7 +408,77 @@ func parseFlags() *Config {
 }
 
 func sendMail(config *Config) error {
-	// If no server specified, try to resolve MX records
+	if config.MergeFile != "" {
+		return runMerge(config)
+	}
+
+	if len(config.DataFiles) > 0 || config.Mbox != "" || config.Maildir != "" {
+		var messages []batchMessage
+		files, err := expandDataFiles(config.DataFiles)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			messages = append(messages, batchMessage{name: f})
+		}
+		for _, source := range []struct {
+			name string
+			read func(string) ([]batchMessage, error)
+		}{
+			{config.Mbox, readMbox},
+			{config.Maildir, readMaildir},
+		} {
+			if source.name == "" {
+				continue
+			}
+			m, err := source.read(source.name)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, m...)
+		}
+		if len(messages) > 1 || config.Mbox != "" || config.Maildir != "" {
+			return runBatch(config, messages)
+		}
+		config.Data = files[0]
+	}
+
+	if config.Reply != "" {
+		if err := applyReply(config); err != nil {
+			return fmt.Errorf("failed to read --reply message: %w", err)
+		}
+	}
+
+	if err := validateAddresses(config); err != nil {
+		return err
+	}
+
+	if err := resolveServer(config); err != nil {
+		return err
+	}
+
+	msg, err := buildMessage(config)
+	if err != nil {
+		return err
+	}
+
+	if config.PrintOnly {
+		fmt.Print(msg.data)
+		return nil
+	}
+
+	client, err := openSession(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Send(msg)
+}
+
+// resolveServer looks up the MX record of the first recipient's domain when
+// no --server was given.
+func resolveServer(config *Config) error {
 	if config.Server == "" {
 		if len(config.To) == 0 && len(config.Cc) == 0 && len(config.Bcc) == 0 {
 			return fmt.Errorf("no server specified and no recipients to resolve MX records")
@@ -269,27 +512,122 @@ func sendMail(config *Config) error {
 		}
 	}
 
-	// Create message
-	message, err := composeMessage(config)
+	return nil
+}
+
+// outgoingMessage is a composed message together with its envelope.
+type outgoingMessage struct {
+	from  string
+	rcpts []string
+	data  string
+}
+
+// buildMessage composes, signs and encrypts the message described by config
+// and determines its envelope sender and recipients.
+func buildMessage(config *Config) (*outgoingMessage, error) {
+	var message string
+	var header mail.Header
+	var err error
+	switch {
+	case config.Bounce != "" && config.Data != "":
+		return nil, fmt.Errorf("--bounce cannot be combined with --data")
+	case config.Bounce != "":
+		message, err = bounceMessage(config)
+	case config.Data != "":
+		message, header, err = loadDataMessage(config)
+	default:
+		message, err = composeMessage(config)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to compose message: %w", err)
+		return nil, fmt.Errorf("failed to compose message: %w", err)
+	}
+	if message, err = secureMessage(config, message); err != nil {
+		return nil, err
 	}
 
-	if config.PrintOnly {
-		fmt.Print(message)
-		return nil
+	msg := &outgoingMessage{from: config.MailFrom, data: message}
+	if msg.from == "" && config.EnvelopeFromHeaders && header != nil {
+		// Return-Path holds the original envelope sender, Sender the
+		// actual submitter of a message written on behalf of From
+		for _, name := range []string{"Return-Path", "Sender", "From"} {
+			if addrs, err := headerAddresses(header, name); err != nil {
+				return nil, err
+			} else if len(addrs) > 0 {
+				msg.from = addrs[0]
+				break
+			}
+		}
+	}
+	if msg.from == "" && config.From != "" {
+		addr, err := mail.ParseAddress(config.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid From address %q: %w", config.From, err)
+		}
+		msg.from = addr.Address
+	}
+
+	if len(config.RcptTo) > 0 {
+		msg.rcpts = config.RcptTo
+	} else if config.EnvelopeFromHeaders && header != nil {
+		if msg.rcpts, err = headerAddresses(header, "To", "Cc", "Bcc"); err != nil {
+			return nil, err
+		}
+	} else {
+		// Extract addresses from To, Cc, Bcc
+		for _, to := range append(append(config.To, config.Cc...), config.Bcc...) {
+			addr, err := mail.ParseAddress(to)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipient address %q: %w", to, err)
+			}
+			msg.rcpts = append(msg.rcpts, addr.Address)
+		}
+	}
+	return msg, nil
+}
+
+// secureMessage applies S/MIME or PGP/MIME protection and the DKIM
+// signature, in that order, as requested by config.
+func secureMessage(config *Config, message string) (string, error) {
+	var err error
+	if config.SMIMESignCert != "" || len(config.SMIMEEncryptCert) > 0 {
+		if message, err = smimeWrap(config, message); err != nil {
+			return "", err
+		}
+	}
+
+	if config.PGPSignKey != "" || len(config.PGPEncryptKey) > 0 {
+		if config.SMIMESignCert != "" || len(config.SMIMEEncryptCert) > 0 {
+			return "", fmt.Errorf("S/MIME and PGP/MIME options cannot be combined")
+		}
+		if message, err = pgpWrap(config, message); err != nil {
+			return "", err
+		}
+	}
+
+	if config.DKIMKey != "" {
+		signer, err := newDKIMSigner(config)
+		if err != nil {
+			return "", err
+		}
+		if message, err = signer.Sign(message); err != nil {
+			return "", err
+		}
 	}
+	return message, nil
+}
 
-	// Connect to SMTP server
+// openSession connects to the server, greets it, starts TLS if possible
+// and authenticates, leaving the client ready for mail transactions.
+func openSession(config *Config) (*SMTPClient, error) {
 	client, err := connectSMTP(config)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
-	defer client.Close()
 
 	// Send EHLO/HELO
 	if err := client.Hello(); err != nil {
-		return fmt.Errorf("failed to send HELO/EHLO: %w", err)
+		client.Close()
+		return nil, fmt.Errorf("failed to send HELO/EHLO: %w", err)
 	}
 
 	// Start TLS if available
@@ -310,51 +648,11 @@ func sendMail(config *Config) error {
 	// Authenticate if credentials provided
 	if config.User != "" {
 		if err := client.Authenticate(); err != nil {
-			return fmt.Errorf("authentication failed: %w", err)
-		}
-	}
-
-	// Set sender
-	mailFrom := config.MailFrom
-	if mailFrom == "" && config.From != "" {
-		addr, err := mail.ParseAddress(config.From)
-		if err == nil {
-			mailFrom = addr.Address
-		} else {
-			mailFrom = config.From
-		}
-	}
-	if err := client.MailFrom(mailFrom); err != nil {
-		return fmt.Errorf("MAIL FROM failed: %w", err)
-	}
-
-	// Add recipients
-	recipients := []string{}
-	if len(config.RcptTo) > 0 {
-		recipients = config.RcptTo
-	} else {
-		// Extract addresses from To, Cc, Bcc
-		for _, to := range append(append(config.To, config.Cc...), config.Bcc...) {
-			if addr, err := mail.ParseAddress(to); err == nil {
-				recipients = append(recipients, addr.Address)
-			} else {
-				recipients = append(recipients, to)
-			}
-		}
-	}
-
-	for _, rcpt := range recipients {
-		if err := client.RcptTo(rcpt); err != nil {
-			return fmt.Errorf("RCPT TO %s failed: %w", rcpt, err)
+			client.Close()
+			return nil, fmt.Errorf("authentication failed: %w", err)
 		}
 	}
-
-	// Send data
-	if err := client.Data(message); err != nil {
-		return fmt.Errorf("DATA failed: %w", err)
-	}
-
-	return nil
+	return client, nil
 }
 
 func connectSMTP(config *Config) (*SMTPClient, error) {
@@ -365,7 +663,7 @@ func connectSMTP(config *Config) (*SMTPClient, error) {
 		network = "tcp6"
 	}
 
-	address := fmt.Sprintf("%s:%d", config.Server, config.Port)
+	address := net.JoinHostPort(config.Server, strconv.Itoa(config.Port))
 	
 	var conn net.Conn
 	var err error
@@ -705,247 +1003,744 @@ func (c *SMTPClient) Data(message string) error {
 	return err
 }
 
-func composeMessage(config *Config) (string, error) {
-	if config.Data != "" {
-		// Read complete message from file
-		var data []byte
-		var err error
-		if config.Data == "-" {
-			data, err = io.ReadAll(os.Stdin)
-		} else {
-			data, err = os.ReadFile(config.Data)
-		}
-		if err != nil {
-			return "", err
-		}
-		return string(data), nil
+// Send runs a complete mail transaction for msg.
+func (c *SMTPClient) Send(msg *outgoingMessage) error {
+	if len(msg.rcpts) == 0 {
+		return fmt.Errorf("no recipients, use --to, --rcpt-to or --envelope-from-headers")
 	}
 
-	// Compose message from components
-	var buf strings.Builder
-	headers := make(map[string]string)
+	if err := c.MailFrom(msg.from); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %w", err)
+	}
 
-	// Basic headers
-	if config.From != "" {
-		headers["From"] = config.From
+	for _, rcpt := range msg.rcpts {
+		if err := c.RcptTo(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO %s failed: %w", rcpt, err)
+		}
 	}
-	if len(config.To) > 0 {
-		headers["To"] = strings.Join(config.To, ", ")
+
+	if err := c.Data(msg.data); err != nil {
+		return fmt.Errorf("DATA failed: %w", err)
 	}
-	if len(config.Cc) > 0 {
-		headers["Cc"] = strings.Join(config.Cc, ", ")
+	return nil
+}
+
+// Reset aborts the current mail transaction.
+func (c *SMTPClient) Reset() error {
+	if c.config.Verbose > 0 {
+		fmt.Println("C: RSET")
+	}
+	if err := c.text.PrintfLine("RSET"); err != nil {
+		return err
 	}
-	if config.Subject != "" {
-		headers["Subject"] = mime.QEncoding.Encode(config.Charset, config.Subject)
+	code, msg, err := c.text.ReadResponse(250)
+	if c.config.Verbose > 0 && code > 0 {
+		fmt.Printf("S: %d %s\n", code, msg)
 	}
-	headers["Date"] = time.Now().Format(time.RFC1123Z)
-	headers["Message-ID"] = fmt.Sprintf("<%d.%d@%s>", time.Now().Unix(), os.Getpid(), getHostname())
-	headers["MIME-Version"] = "1.0"
+	return err
+}
 
-	// Apply header modifications
-	for _, h := range config.RemoveHeader {
-		delete(headers, h)
+// loadDataMessage reads the --data message (or uses DataContent, for a
+// message taken from a mailbox), applies the header options to
+// it and removes the Bcc and Return-Path headers. It also returns the parsed header, which
+// still includes Bcc, for deriving the envelope.
+func loadDataMessage(config *Config) (string, mail.Header, error) {
+	var data []byte
+	var err error
+	if config.DataContent != nil {
+		data = config.DataContent
+	} else if config.Data == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(config.Data)
 	}
-	for _, h := range config.ReplaceHeader {
-		parts := strings.SplitN(h, ":", 2)
-		if len(parts) == 2 {
-			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
-		}
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Write headers
-	for k, v := range headers {
-		buf.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+	header, body := splitMessage(normalizeCRLF(string(data)))
+	if header, err = editHeader(config, header); err != nil {
+		return "", nil, err
 	}
-	for _, h := range config.AddHeader {
-		buf.WriteString(h + "\r\n")
+	m, err := mail.ReadMessage(strings.NewReader(header + "\r\n"))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid message header in %s: %w", config.Data, err)
 	}
 
-	// Determine content type and write body
-	hasAttachments := len(config.Attach) > 0 || len(config.AttachInline) > 0
-	hasMultipleBodyParts := config.BodyPlain != "" && config.BodyHTML != ""
-
-	if hasAttachments || hasMultipleBodyParts {
-		// Multipart message
-		boundary := fmt.Sprintf("----=_Part_%d_%d", time.Now().Unix(), os.Getpid())
-		
-		if hasAttachments && hasMultipleBodyParts {
-			buf.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary))
-		} else if hasMultipleBodyParts {
-			buf.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=\"%s\"\r\n", boundary))
-		} else {
-			buf.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary))
-		}
-		buf.WriteString("\r\n")
+	// Return-Path is added on final delivery and must not be sent on
+	// (RFC 5321 section 4.4)
+	message := removeHeaderFields(header+"\r\n"+body, func(name string) bool {
+		return strings.EqualFold(name, "Bcc") || strings.EqualFold(name, "Return-Path")
+	})
+	return message, m.Header, nil
+}
 
-		// Write body parts
-		if config.BodyPlain != "" {
-			buf.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-			buf.WriteString(fmt.Sprintf("Content-Type: text/plain; charset=\"%s\"\r\n", config.Charset))
-			buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n\r\n", config.TextEncoding))
-			body, err := readBodyContent(config.BodyPlain)
-			if err != nil {
-				return "", err
-			}
-			buf.WriteString(encodeBody(body, config.TextEncoding))
-			buf.WriteString("\r\n")
+// editHeader applies --remove-header, --replace-header and --add-header to
+// a header block. Header names are matched case-insensitively and every
+// instance of a repeated header is affected; --remove-header also accepts
+// wildcard patterns such as "X-*". A replaced header keeps the position of
+// its first instance.
+func editHeader(config *Config, header string) (string, error) {
+	fields := parseHeaderFields(header)
+	for _, pattern := range config.RemoveHeader {
+		pattern = strings.TrimSuffix(strings.TrimSpace(pattern), ":")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", fmt.Errorf("invalid --remove-header pattern %q: %w", pattern, err)
 		}
-
-		if config.BodyHTML != "" {
-			buf.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-			
-			if len(config.AttachInline) > 0 {
-				// Multipart/related for inline attachments
-				relatedBoundary := fmt.Sprintf("----=_Related_%d_%d", time.Now().Unix(), os.Getpid())
-				buf.WriteString(fmt.Sprintf("Content-Type: multipart/related; boundary=\"%s\"\r\n\r\n", relatedBoundary))
-				
-				buf.WriteString(fmt.Sprintf("--%s\r\n", relatedBoundary))
-				buf.WriteString(fmt.Sprintf("Content-Type: text/html; charset=\"%s\"\r\n", config.Charset))
-				buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n\r\n", config.TextEncoding))
-				body, err := readBodyContent(config.BodyHTML)
-				if err != nil {
-					return "", err
-				}
-				buf.WriteString(encodeBody(body, config.TextEncoding))
-				buf.WriteString("\r\n")
-				
-				// Add inline attachments
-				for _, attachment := range config.AttachInline {
-					if err := addAttachment(&buf, attachment, relatedBoundary, true); err != nil {
-						return "", err
-					}
-				}
-				
-				buf.WriteString(fmt.Sprintf("--%s--\r\n", relatedBoundary))
-			} else {
-				buf.WriteString(fmt.Sprintf("Content-Type: text/html; charset=\"%s\"\r\n", config.Charset))
-				buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n\r\n", config.TextEncoding))
-				body, err := readBodyContent(config.BodyHTML)
-				if err != nil {
-					return "", err
-				}
-				buf.WriteString(encodeBody(body, config.TextEncoding))
-				buf.WriteString("\r\n")
-			}
+		fields = slices.DeleteFunc(fields, func(f headerField) bool {
+			return headerNameMatches(pattern, f.name)
+		})
+	}
+	for _, h := range config.ReplaceHeader {
+		h, err := decodeInput(config, h)
+		if err != nil {
+			return "", fmt.Errorf("--replace-header: %w", err)
 		}
-
-		// Add regular attachments
-		for _, attachment := range config.Attach {
-			if err := addAttachment(&buf, attachment, boundary, false); err != nil {
-				return "", err
-			}
+		field, err := newHeaderField(h)
+		if err != nil {
+			return "", err
 		}
-
-		buf.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
-	} else {
-		// Simple message
-		if config.BodyHTML != "" {
-			buf.WriteString(fmt.Sprintf("Content-Type: text/html; charset=\"%s\"\r\n", config.Charset))
-			buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n\r\n", config.TextEncoding))
-			body, err := readBodyContent(config.BodyHTML)
-			if err != nil {
-				return "", err
-			}
-			buf.WriteString(encodeBody(body, config.TextEncoding))
-		} else if config.BodyPlain != "" {
-			buf.WriteString(fmt.Sprintf("Content-Type: text/plain; charset=\"%s\"\r\n", config.Charset))
-			buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n\r\n", config.TextEncoding))
-			body, err := readBodyContent(config.BodyPlain)
-			if err != nil {
-				return "", err
-			}
-			buf.WriteString(encodeBody(body, config.TextEncoding))
+		isSame := func(f headerField) bool { return strings.EqualFold(f.name, field.name) }
+		if i := slices.IndexFunc(fields, isSame); i >= 0 {
+			fields[i] = field
+			fields = append(fields[:i+1], slices.DeleteFunc(fields[i+1:], isSame)...)
 		} else {
-			buf.WriteString("\r\n")
+			fields = append(fields, field)
 		}
 	}
-
-	return buf.String(), nil
-}
-
-func readBodyContent(input string) (string, error) {
-	// Check if input is a filename
-	if _, err := os.Stat(input); err == nil {
-		data, err := os.ReadFile(input)
+	for _, h := range config.AddHeader {
+		h, err := decodeInput(config, h)
+		if err != nil {
+			return "", fmt.Errorf("--add-header: %w", err)
+		}
+		field, err := newHeaderField(h)
 		if err != nil {
 			return "", err
 		}
-		return string(data), nil
+		fields = append(fields, field)
 	}
-	// Otherwise treat as literal content
-	return input, nil
+
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f.raw + "\r\n")
+	}
+	return b.String(), nil
 }
 
-func encodeBody(body, encoding string) string {
-	switch encoding {
-	case "base64":
-		return base64.StdEncoding.EncodeToString([]byte(body))
-	case "quoted-printable":
-		// Simple quoted-printable encoding
-		var buf strings.Builder
-		for i, b := range []byte(body) {
-			if b == '=' || b < 32 || b > 126 {
-				buf.WriteString(fmt.Sprintf("=%02X", b))
-			} else {
-				buf.WriteByte(b)
+// newHeaderField parses a "Name: value" option argument into an encoded
+// header field.
+func newHeaderField(h string) (headerField, error) {
+	name, value, ok := strings.Cut(h, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || !validFieldName(name) {
+		return headerField{}, fmt.Errorf("invalid header %q, expected \"Name: value\"", h)
+	}
+	value, err := formatHeaderValue(name, value)
+	if err != nil {
+		return headerField{}, err
+	}
+	return headerField{name: name, raw: name + ": " + value}, nil
+}
+
+// headerNameMatches reports whether a header name matches pattern, ignoring
+// case. The pattern may use the wildcards of path.Match.
+func headerNameMatches(pattern, name string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return ok
+}
+
+func composeMessage(config *Config) (string, error) {
+	if config.MimeTypes != "" {
+		if err := loadMimeTypes(config.MimeTypes); err != nil {
+			return "", fmt.Errorf("failed to load MIME types: %w", err)
+		}
+	}
+
+	var vars map[string]any
+	if usesTemplates(config) {
+		var err error
+		if vars, err = templateData(config); err != nil {
+			return "", err
+		}
+	}
+	invite, err := loadInvite(config)
+	if err != nil {
+		return "", err
+	}
+
+	// Compose message from components
+	var buf strings.Builder
+	var header strings.Builder
+
+	// Basic headers
+	if config.From != "" {
+		from, err := formatAddressList("From", []string{config.From}, config.Charset)
+		if err != nil {
+			return "", err
+		}
+		header.WriteString("From: " + from + "\r\n")
+	}
+	if len(config.To) > 0 {
+		to, err := formatAddressList("To", config.To, config.Charset)
+		if err != nil {
+			return "", err
+		}
+		header.WriteString("To: " + to + "\r\n")
+	}
+	if len(config.Cc) > 0 {
+		cc, err := formatAddressList("Cc", config.Cc, config.Charset)
+		if err != nil {
+			return "", err
+		}
+		header.WriteString("Cc: " + cc + "\r\n")
+	}
+	if len(config.ReplyTo) > 0 {
+		replyTo, err := formatAddressList("Reply-To", config.ReplyTo, config.Charset)
+		if err != nil {
+			return "", err
+		}
+		header.WriteString("Reply-To: " + replyTo + "\r\n")
+	}
+	subject, err := decodeInput(config, config.Subject)
+	if err != nil {
+		return "", fmt.Errorf("--subject: %w", err)
+	}
+	if subject != "" && vars != nil {
+		if subject, err = renderTemplate("subject", subject, vars, false); err != nil {
+			return "", err
+		}
+	}
+	if subject == "" && len(config.Forward) > 0 {
+		subject = forwardSubject(config.Forward[0])
+	}
+	if subject == "" && invite != nil {
+		subject = inviteSubject(invite)
+	}
+	if subject != "" && config.Subject == "" {
+		// Derived from the forwarded message or the event, in UTF-8
+		if subject, err = generatedText(config, subject); err != nil {
+			return "", fmt.Errorf("subject: %w", err)
+		}
+	}
+	if subject != "" {
+		encoded, err := encodeOutput(config, subject)
+		if err != nil {
+			return "", fmt.Errorf("subject: %w", err)
+		}
+		header.WriteString("Subject: " + encodeHeaderText(config.Charset, encoded) + "\r\n")
+	}
+	header.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	header.WriteString("Message-ID: " + newMessageID() + "\r\n")
+	for _, h := range []struct {
+		name   string
+		values []string
+	}{
+		{"In-Reply-To", []string{config.InReplyTo}},
+		{"References", config.References},
+	} {
+		ids, err := formatMsgIDs(h.name, h.values)
+		if err != nil {
+			return "", err
+		}
+		if ids != "" {
+			header.WriteString(h.name + ": " + ids + "\r\n")
+		}
+	}
+	header.WriteString("MIME-Version: 1.0\r\n")
+
+	// Apply header modifications
+	edited, err := editHeader(config, header.String())
+	if err != nil {
+		return "", err
+	}
+	buf.WriteString(edited)
+
+	// Write body
+	body, err := messageBody(config, vars, invite)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		if err := body(&buf); err != nil {
+			return "", err
+		}
+	} else {
+		buf.WriteString("\r\n")
+	}
+
+	return buf.String(), nil
+}
+
+// addressHeaders lists the headers whose values are address lists and
+// therefore need to be parsed and re-encoded rather than written verbatim.
+var addressHeaders = map[string]bool{
+	"From":          true,
+	"Sender":        true,
+	"Reply-To":      true,
+	"To":            true,
+	"Cc":            true,
+	"Bcc":           true,
+	"Resent-From":   true,
+	"Resent-Sender": true,
+	"Resent-To":     true,
+	"Resent-Cc":     true,
+	"Resent-Bcc":    true,
+}
+
+// appendAddresses parses a comma-separated address list as given on the
+// command line and appends each address to list in canonical form.
+func appendAddresses(list *[]string, s string) error {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	addrs, err := addressParser.ParseList(s)
+	if err != nil {
+		return fmt.Errorf("invalid address list %q: %w", s, err)
+	}
+	for _, addr := range addrs {
+		*list = append(*list, formatAddress(addr))
+	}
+	return nil
+}
+
+// validateAddresses checks every sender and recipient address before any
+// connection is made so that typos are reported instead of being sent as-is.
+func validateAddresses(config *Config) error {
+	if config.From != "" {
+		if _, err := mail.ParseAddress(config.From); err != nil {
+			return fmt.Errorf("invalid From address %q: %w", config.From, err)
+		}
+	}
+	if config.MailFrom != "" {
+		if _, err := mail.ParseAddress(config.MailFrom); err != nil {
+			return fmt.Errorf("invalid MAIL FROM address %q: %w", config.MailFrom, err)
+		}
+	}
+	for _, list := range []struct {
+		name  string
+		addrs []string
+	}{
+		{"To", config.To},
+		{"Cc", config.Cc},
+		{"Bcc", config.Bcc},
+		{"RCPT TO", config.RcptTo},
+	} {
+		for _, a := range list.addrs {
+			if _, err := mail.ParseAddress(a); err != nil {
+				return fmt.Errorf("invalid %s address %q: %w", list.name, a, err)
+			}
+		}
+	}
+	return nil
+}
+
+// formatAddress renders an address for use in a header, quoting the display
+// name if it contains specials and RFC 2047 encoding it if it is not ASCII.
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.String()
+}
+
+// flagValueError reports an option that cannot be parsed or converted the
+// way the flag package reports invalid values, and exits.
+func flagValueError(name, value string, err error) {
+	fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -%s: %v\n", value, name, err)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// formatAddressList parses each entry and joins them into a header value,
+// encoding display names in charset.
+func formatAddressList(header string, list []string, charset string) (string, error) {
+	formatted := make([]string, 0, len(list))
+	for _, entry := range list {
+		addrs, err := mail.ParseAddressList(entry)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s address %q: %w", header, entry, err)
+		}
+		for _, addr := range addrs {
+			if canonicalCharset(charset) == "UTF-8" || isASCII(addr.Name) {
+				formatted = append(formatted, formatAddress(addr))
+				continue
+			}
+			c, err := lookupCharset(charset)
+			if err != nil {
+				return "", err
+			}
+			name, err := c.encode(addr.Name)
+			if err != nil {
+				return "", fmt.Errorf("%s address %q: %w", header, addr.Name, err)
+			}
+			formatted = append(formatted, encodeHeaderText(charset, name)+" <"+addr.Address+">")
+		}
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+// formatHeaderValue encodes a user-supplied header value, re-encoding
+// address lists for the known address headers and RFC 2047 encoding other
+// values that are not plain ASCII.
+func formatHeaderValue(name, value string) (string, error) {
+	if addressHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		return formatAddressList(name, []string{value}, "UTF-8")
+	}
+	return encodeHeaderText("UTF-8", value), nil
+}
+
+// encodeHeaderText RFC 2047 encodes unstructured header text, which is
+// already in charset, if needed, folding between encoded-words to keep lines
+// short.
+func encodeHeaderText(charset, text string) string {
+	if canonicalCharset(charset) != "UTF-8" {
+		// mime.WordEncoder only splits UTF-8 text into words
+		return encodeWords(charset, text)
+	}
+	return strings.ReplaceAll(mime.QEncoding.Encode(charset, text), "?= =?", "?=\r\n =?")
+}
+
+// newMessageID returns a new msg-id in angle brackets. The counter in
+// uniqueID keeps the messages of one run distinct, the random part those of
+// processes that reuse a PID.
+func newMessageID() string {
+	random := make([]byte, 6)
+	rand.Read(random)
+	return "<" + uniqueID() + "." + hex.EncodeToString(random) + "@" + getHostname() + ">"
+}
+
+// partWriter writes a MIME entity: its Content-* headers, a blank line and
+// the encoded content.
+type partWriter func(buf *strings.Builder) error
+
+// messageBody builds the MIME tree for the message content:
+//
+//	multipart/mixed
+//	├── multipart/alternative
+//	│   ├── text/plain
+//	│   ├── multipart/related
+//	│   │   ├── text/html
+//	│   │   └── inline attachments
+//	│   └── text/calendar (invitations)
+//	├── attachments
+//	├── forwarded messages (message/rfc822)
+//	└── invite.ics
+//
+// Alternative and related levels with a single child are collapsed into that
+// child, as is multipart/mixed when there are no attachments. Without an HTML
+// body inline attachments are placed in multipart/mixed with an inline
+// disposition. If vars is not nil the bodies are rendered as templates. An
+// invitation without a body gets a plain text description of the event. It
+// returns nil if the message has no content at all.
+func messageBody(config *Config, vars map[string]any, invite *calendarInvite) (partWriter, error) {
+	attachments, err := parseAttachmentSpecs(config.Attach)
+	if err != nil {
+		return nil, err
+	}
+	inlines, err := parseAttachmentSpecs(config.AttachInline)
+	if err != nil {
+		return nil, err
+	}
+
+	var plainBody, htmlBody string
+	hasPlain, hasHTML := config.BodyPlain != "", config.BodyHTML != ""
+	htmlSource := config.BodyHTML
+	if hasPlain {
+		if plainBody, err = readBody(config, "body-plain", config.BodyPlain, vars, false); err != nil {
+			return nil, err
+		}
+	}
+	if hasHTML {
+		if htmlBody, err = readBody(config, "body-html", config.BodyHTML, vars, true); err != nil {
+			return nil, err
+		}
+	}
+	if config.BodyMarkdown != "" {
+		if hasPlain || hasHTML {
+			return nil, fmt.Errorf("--body-markdown cannot be combined with --body-plain or --body-html")
+		}
+		// The Markdown source doubles as the plain text alternative
+		source, err := readBody(config, "body-markdown", config.BodyMarkdown, vars, false)
+		if err != nil {
+			return nil, err
+		}
+		plainBody, htmlBody = source, markdownDocument(renderMarkdown(source), config.Charset)
+		hasPlain, hasHTML, htmlSource = true, true, config.BodyMarkdown
+	}
+	if config.CleanHTML && hasHTML {
+		var warnings []string
+		htmlBody, warnings = cleanHTML(htmlBody)
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+		}
+	}
+	if config.AutoText && hasHTML && !hasPlain {
+		plainBody, hasPlain = htmlToText(htmlBody), true
+	}
+
+	var plain, html partWriter
+	if hasPlain {
+		plain = textPart(config, "plain", plainBody)
+	}
+	if hasHTML {
+		body := htmlBody
+		if config.EmbedImages {
+			baseDir := "."
+			if _, err := os.Stat(htmlSource); err == nil {
+				baseDir = filepath.Dir(htmlSource)
+			}
+			body, inlines, err = embedImages(body, baseDir, inlines)
+			if err != nil {
+				return nil, err
+			}
+		}
+		body, err = assignContentIDs(body, inlines)
+		if err != nil {
+			return nil, err
+		}
+		html = textPart(config, "html", body)
+		if len(inlines) > 0 {
+			related := []partWriter{html}
+			for _, spec := range inlines {
+				related = append(related, attachmentPart(spec, true))
+			}
+			html = multipartPart("multipart/related; type=\"text/html\"", related)
+		}
+	} else if _, err := assignContentIDs("", inlines); err != nil {
+		return nil, err
+	}
+
+	if invite != nil && plain == nil && html == nil {
+		text, err := generatedText(config, invite.text)
+		if err != nil {
+			return nil, fmt.Errorf("invitation text: %w", err)
+		}
+		plain = textPart(config, "plain", text)
+	}
+	var alternatives []partWriter
+	for _, part := range []partWriter{plain, html} {
+		if part != nil {
+			alternatives = append(alternatives, part)
+		}
+	}
+	if invite != nil {
+		alternatives = append(alternatives, calendarPart(config, invite))
+	}
+
+	var mixed []partWriter
+	switch len(alternatives) {
+	case 0:
+	case 1:
+		mixed = append(mixed, alternatives[0])
+	default:
+		mixed = append(mixed, multipartPart("multipart/alternative", alternatives))
+	}
+	if html == nil {
+		for _, spec := range inlines {
+			mixed = append(mixed, attachmentPart(spec, true))
+		}
+	}
+	for _, spec := range attachments {
+		mixed = append(mixed, attachmentPart(spec, false))
+	}
+	for _, filename := range config.Forward {
+		mixed = append(mixed, forwardPart(filename))
+	}
+	if invite != nil {
+		mixed = append(mixed, calendarAttachmentPart(invite))
+	}
+
+	switch {
+	case len(mixed) == 0:
+		return nil, nil
+	case len(mixed) == 1 && len(alternatives) > 0:
+		return mixed[0], nil
+	default:
+		return multipartPart("multipart/mixed", mixed), nil
+	}
+}
+
+// textPart returns a writer for a text/plain or text/html body part.
+func textPart(config *Config, subtype, body string) partWriter {
+	return func(buf *strings.Builder) error {
+		body, err := encodeOutput(config, body)
+		if err != nil {
+			return fmt.Errorf("text/%s body: %w", subtype, err)
+		}
+		buf.WriteString(fmt.Sprintf("Content-Type: text/%s; charset=\"%s\"\r\n", subtype, config.Charset))
+		buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n\r\n", config.TextEncoding))
+		buf.WriteString(encodeBody(body, config.TextEncoding))
+		return nil
+	}
+}
+
+// attachmentPart returns a writer for a file attachment.
+func attachmentPart(spec *attachmentSpec, inline bool) partWriter {
+	return func(buf *strings.Builder) error {
+		return addAttachment(buf, spec, inline)
+	}
+}
+
+// idCount keeps generated boundaries and Content-IDs distinct within a
+// process.
+var idCount int
+
+// uniqueID returns the unique part of a generated boundary or Content-ID:
+// the time, the process ID and a counter. Tests replace it to get
+// reproducible messages.
+var uniqueID = func() string {
+	idCount++
+	return fmt.Sprintf("%d.%d.%d", time.Now().Unix(), os.Getpid(), idCount)
+}
+
+// multipartPart returns a writer for a multipart entity of the given
+// Content-Type containing parts.
+func multipartPart(contentType string, parts []partWriter) partWriter {
+	return func(buf *strings.Builder) error {
+		boundary := "----=_Part_" + uniqueID()
+		writeParamHeader(buf, "Content-Type", contentType, []string{fmt.Sprintf("boundary=\"%s\"", boundary)})
+		buf.WriteString("\r\n")
+		for _, part := range parts {
+			buf.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+			if err := part(buf); err != nil {
+				return err
 			}
-			if i > 0 && i%76 == 0 {
-				buf.WriteString("=\r\n")
+			// The CRLF before the next delimiter belongs to the delimiter
+			if !strings.HasSuffix(buf.String(), "\r\n") {
+				buf.WriteString("\r\n")
 			}
 		}
+		buf.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+		return nil
+	}
+}
+
+// readBody reads a body option, converts it from --input-charset and, if
+// vars is not nil, renders it as a template named after the option.
+func readBody(config *Config, name, input string, vars map[string]any, html bool) (string, error) {
+	body, err := readBodyContent(input)
+	if err != nil {
+		return "", err
+	}
+	if body, err = decodeInput(config, body); err != nil {
+		return "", fmt.Errorf("--%s: %w", name, err)
+	}
+	if vars == nil {
+		return body, nil
+	}
+	return renderTemplate(name, body, vars, html)
+}
+
+func readBodyContent(input string) (string, error) {
+	// Check if input is a filename
+	if _, err := os.Stat(input); err == nil {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	// Otherwise treat as literal content
+	return input, nil
+}
+
+func encodeBody(body, encoding string) string {
+	switch encoding {
+	case "base64":
+		return wrapBase64([]byte(body))
+	case "quoted-printable":
+		// Line breaks stay hard breaks; long lines get soft breaks at 76
+		var buf strings.Builder
+		w := quotedprintable.NewWriter(&buf)
+		w.Write([]byte(body))
+		w.Close()
 		return buf.String()
+	case "7bit", "8bit":
+		return normalizeCRLF(body)
 	default:
 		return body
 	}
 }
 
-func addAttachment(buf *strings.Builder, attachment, boundary string, inline bool) error {
-	// Parse attachment (filename[@mimetype])
-	parts := strings.SplitN(attachment, "@", 2)
-	filename := parts[0]
-	
-	data, err := os.ReadFile(filename)
+// attachmentSpec is a parsed --attach/--attach-inline argument of the form
+// filename[@mimetype][;name=displayname][;cid=contentid]. Other ;key=value
+// fields are taken as parameters of the given MIME type.
+type attachmentSpec struct {
+	Path      string
+	MimeType  string
+	Name      string
+	ContentID string
+}
+
+func parseAttachmentSpecs(attachments []string) ([]*attachmentSpec, error) {
+	specs := make([]*attachmentSpec, 0, len(attachments))
+	for _, attachment := range attachments {
+		spec, err := parseAttachmentSpec(attachment)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func parseAttachmentSpec(attachment string) (*attachmentSpec, error) {
+	fields := strings.Split(attachment, ";")
+	parts := strings.SplitN(fields[0], "@", 2)
+	spec := &attachmentSpec{Path: parts[0]}
+	if len(parts) > 1 {
+		spec.MimeType = parts[1]
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid attachment option %q in %q", field, attachment)
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "name":
+			spec.Name = kv[1]
+		case "cid":
+			spec.ContentID = strings.Trim(kv[1], "<>")
+		default:
+			if spec.MimeType == "" {
+				return nil, fmt.Errorf("unknown attachment option %q in %q", kv[0], attachment)
+			}
+			spec.MimeType += ";" + field
+		}
+	}
+	if spec.Name == "" {
+		spec.Name = filepath.Base(spec.Path)
+	}
+	return spec, nil
+}
+
+func addAttachment(buf *strings.Builder, spec *attachmentSpec, inline bool) error {
+	data, err := os.ReadFile(spec.Path)
 	if err != nil {
 		return err
 	}
 
-	mimeType := "application/octet-stream"
-	if len(parts) > 1 {
-		mimeType = parts[1]
-	} else {
-		// Guess MIME type from extension
-		ext := strings.ToLower(filepath.Ext(filename))
-		switch ext {
-		case ".txt":
-			mimeType = "text/plain"
-		case ".html", ".htm":
-			mimeType = "text/html"
-		case ".jpg", ".jpeg":
-			mimeType = "image/jpeg"
-		case ".png":
-			mimeType = "image/png"
-		case ".gif":
-			mimeType = "image/gif"
-		case ".pdf":
-			mimeType = "application/pdf"
-		case ".zip":
-			mimeType = "application/zip"
-		}
-	}
-
-	buf.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	buf.WriteString(fmt.Sprintf("Content-Type: %s; name=\"%s\"\r\n", mimeType, filepath.Base(filename)))
+	mimeType := spec.MimeType
+	if mimeType == "" {
+		mimeType = detectMimeType(spec.Path, data)
+	}
+	mimeType, err = addTextCharset(mimeType, data)
+	if err != nil {
+		return fmt.Errorf("invalid MIME type for %s: %w", spec.Path, err)
+	}
+
+	writeParamHeader(buf, "Content-Type", mimeType, encodeParam("name", spec.Name))
 	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
-	
+
 	if inline {
-		buf.WriteString(fmt.Sprintf("Content-ID: <%s>\r\n", filepath.Base(filename)))
-		buf.WriteString("Content-Disposition: inline\r\n")
+		buf.WriteString(fmt.Sprintf("Content-ID: <%s>\r\n", spec.ContentID))
+		writeParamHeader(buf, "Content-Disposition", "inline", encodeParam("filename", spec.Name))
 	} else {
-		buf.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", filepath.Base(filename)))
+		writeParamHeader(buf, "Content-Disposition", "attachment", encodeParam("filename", spec.Name))
 	}
-	
+
 	buf.WriteString("\r\n")
-	
+
 	// Encode in base64 with proper line breaks
 	encoded := base64.StdEncoding.EncodeToString(data)
 	for i := 0; i < len(encoded); i += 76 {
@@ -956,10 +1751,427 @@ func addAttachment(buf *strings.Builder, attachment, boundary string, inline boo
 		buf.WriteString(encoded[i:end])
 		buf.WriteString("\r\n")
 	}
-	
+
 	return nil
 }
 
+// newContentID returns a unique msg-id style Content-ID derived from name.
+func newContentID(name string) string {
+	local := strings.Map(func(r rune) rune {
+		if r < 0x80 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)) {
+			return r
+		}
+		return -1
+	}, name)
+	if local == "" {
+		local = "part"
+	}
+	return local + "." + uniqueID() + "@" + getHostname()
+}
+
+var cidRefPattern = regexp.MustCompile(`(?i)\bcid:([^"'\s>)]+)`)
+
+// assignContentIDs gives every inline attachment an RFC 5322 msg-id as its
+// Content-ID and rewrites cid: references in the HTML body to match. An
+// explicit ;cid= value that is already a valid msg-id is used verbatim;
+// otherwise the generated ID replaces it, as well as references by the
+// attachment's file name.
+func assignContentIDs(html string, inlines []*attachmentSpec) (string, error) {
+	refs := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, spec := range inlines {
+		if spec.ContentID != "" {
+			if seen[spec.ContentID] {
+				return "", fmt.Errorf("duplicate Content-ID %q for %s", spec.ContentID, spec.Path)
+			}
+			seen[spec.ContentID] = true
+		}
+	}
+
+	for _, spec := range inlines {
+		explicit := spec.ContentID
+		if explicit != "" && isMsgID(explicit) {
+			continue
+		}
+		name := explicit
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(spec.Path), filepath.Ext(spec.Path))
+		}
+		spec.ContentID = newContentID(name)
+		if explicit != "" {
+			refs[explicit] = spec.ContentID
+		} else if base := filepath.Base(spec.Path); !seen[base] {
+			// Keep the historic cid:<file name> references working
+			if _, dup := refs[base]; dup {
+				refs[base] = ""
+			} else {
+				refs[base] = spec.ContentID
+			}
+		}
+	}
+
+	return cidRefPattern.ReplaceAllStringFunc(html, func(ref string) string {
+		if id := refs[ref[len("cid:"):]]; id != "" {
+			return ref[:len("cid:")] + id
+		}
+		return ref
+	}), nil
+}
+
+// isMsgID reports whether id (without angle brackets) is a dot-atom msg-id.
+func isMsgID(id string) bool {
+	left, right, ok := strings.Cut(id, "@")
+	if !ok || left == "" || right == "" {
+		return false
+	}
+	_, err := mail.ParseAddress("<" + id + ">")
+	return err == nil
+}
+
+var imgSrcPattern = regexp.MustCompile(`(?i)(<img\b[^>]*?\bsrc\s*=\s*)(["'])([^"']*)(["'])`)
+
+var urlSchemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// embedImages finds <img src="..."> references to local files in the HTML
+// body, adds each file as an inline attachment and rewrites the src to a
+// cid: URL. Relative paths are resolved against baseDir.
+func embedImages(html, baseDir string, inlines []*attachmentSpec) (string, []*attachmentSpec, error) {
+	embedded := make(map[string]*attachmentSpec)
+	var embedErr error
+	html = imgSrcPattern.ReplaceAllStringFunc(html, func(tag string) string {
+		m := imgSrcPattern.FindStringSubmatch(tag)
+		src := m[3]
+		if src == "" || embedErr != nil || urlSchemePattern.MatchString(src) || strings.HasPrefix(src, "//") {
+			return tag
+		}
+		path := src
+		if unescaped, err := url.PathUnescape(src); err == nil {
+			path = unescaped
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, filepath.FromSlash(path))
+		}
+		spec, ok := embedded[path]
+		if !ok {
+			if _, err := os.Stat(path); err != nil {
+				embedErr = fmt.Errorf("failed to embed image %q: %w", src, err)
+				return tag
+			}
+			spec = &attachmentSpec{Path: path, Name: filepath.Base(path)}
+			spec.ContentID = newContentID(strings.TrimSuffix(spec.Name, filepath.Ext(spec.Name)))
+			embedded[path] = spec
+			inlines = append(inlines, spec)
+		}
+		return m[1] + m[2] + "cid:" + spec.ContentID + m[4]
+	})
+	if embedErr != nil {
+		return "", nil, embedErr
+	}
+	return html, inlines, nil
+}
+
+// extraMimeTypes covers common attachment types that are missing from Go's
+// builtin table on systems without a mime.types file (Windows, macOS).
+var extraMimeTypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".eml":  "message/rfc822",
+	".gz":   "application/gzip",
+	".ics":  "text/calendar",
+	".log":  "text/plain",
+	".md":   "text/markdown",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ogg":  "audio/ogg",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".rtf":  "application/rtf",
+	".tar":  "application/x-tar",
+	".tgz":  "application/gzip",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".txt":  "text/plain",
+	".vcf":  "text/vcard",
+	".wav":  "audio/wav",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".zip":  "application/zip",
+}
+
+// magicTypes maps leading file signatures to MIME types. Entries with an
+// offset match at that position; the first match wins.
+var magicTypes = []struct {
+	offset int
+	magic  string
+	mime   string
+}{
+	{0, "%PDF-", "application/pdf"},
+	{0, "\x89PNG\r\n\x1a\n", "image/png"},
+	{0, "GIF87a", "image/gif"},
+	{0, "GIF89a", "image/gif"},
+	{0, "\xff\xd8\xff", "image/jpeg"},
+	{0, "BM", "image/bmp"},
+	{0, "II*\x00", "image/tiff"},
+	{0, "MM\x00*", "image/tiff"},
+	{0, "\x00\x00\x01\x00", "image/x-icon"},
+	{8, "WEBP", "image/webp"},
+	{8, "WAVE", "audio/wav"},
+	{8, "AVI ", "video/x-msvideo"},
+	{4, "ftyp", "video/mp4"},
+	{0, "OggS", "application/ogg"},
+	{0, "ID3", "audio/mpeg"},
+	{0, "fLaC", "audio/flac"},
+	{0, "\x1a\x45\xdf\xa3", "video/webm"},
+	{0, "PK\x03\x04", "application/zip"},
+	{0, "\x1f\x8b\x08", "application/gzip"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "Rar!\x1a\x07", "application/vnd.rar"},
+	{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+	{0, "{\\rtf", "application/rtf"},
+	{0, "%!PS", "application/postscript"},
+	{0, "\x7fELF", "application/x-executable"},
+	{0, "wOFF", "font/woff"},
+	{0, "wOF2", "font/woff2"},
+}
+
+// textMagicTypes are signatures for text formats, matched case-insensitively
+// after skipping a byte order mark and leading whitespace.
+var textMagicTypes = []struct {
+	magic string
+	mime  string
+}{
+	{"<!doctype html", "text/html"},
+	{"<html", "text/html"},
+	{"<?xml", "text/xml"},
+	{"<svg", "image/svg+xml"},
+	{"begin:vcalendar", "text/calendar"},
+	{"begin:vcard", "text/vcard"},
+}
+
+// detectMimeType picks a MIME type for an attachment from its extension,
+// falling back to sniffing the content when the extension is unknown.
+func detectMimeType(filename string, data []byte) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != "" {
+		if t := mime.TypeByExtension(ext); t != "" {
+			// Drop the table's charset guess; addTextCharset looks at the content
+			if mediaType, _, err := mime.ParseMediaType(t); err == nil {
+				return mediaType
+			}
+			return t
+		}
+		if t, ok := extraMimeTypes[ext]; ok {
+			return t
+		}
+	}
+	return sniffMimeType(data)
+}
+
+// sniffMimeType guesses a MIME type from the first bytes of data.
+func sniffMimeType(data []byte) string {
+	head := data[:min(len(data), 512)]
+	for _, m := range magicTypes {
+		if len(head) >= m.offset+len(m.magic) && string(head[m.offset:m.offset+len(m.magic)]) == m.magic {
+			return m.mime
+		}
+	}
+
+	text := strings.TrimLeft(strings.TrimPrefix(string(head), "\xef\xbb\xbf"), " \t\r\n")
+	for _, m := range textMagicTypes {
+		if len(text) >= len(m.magic) && strings.EqualFold(text[:len(m.magic)], m.magic) {
+			return m.mime
+		}
+	}
+
+	if isText(head) {
+		return "text/plain"
+	}
+	return "application/octet-stream"
+}
+
+// isText reports whether data looks like text, i.e. has a UTF-16 byte order
+// mark or contains no control characters other than whitespace.
+func isText(data []byte) bool {
+	if bytes.HasPrefix(data, []byte{0xfe, 0xff}) || bytes.HasPrefix(data, []byte{0xff, 0xfe}) {
+		return true
+	}
+	for _, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != 0x1b {
+			return false
+		}
+	}
+	return true
+}
+
+// addTextCharset adds a charset parameter to text/* types that do not have
+// one, based on the attachment content.
+func addTextCharset(mimeType string, data []byte) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(mediaType, "text/") {
+		return mimeType, nil
+	}
+	if _, ok := params["charset"]; !ok {
+		if charset := detectCharset(data); charset != "" {
+			params["charset"] = charset
+		}
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// detectCharset returns the charset of a text attachment, or "" if it
+// cannot be determined.
+func detectCharset(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}), bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return "utf-16"
+	case !utf8.Valid(data):
+		return ""
+	case isPrintableASCII(strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || r == '\f' {
+			return ' '
+		}
+		return r
+	}, string(data))):
+		return "us-ascii"
+	default:
+		return "utf-8"
+	}
+}
+
+// loadMimeTypes registers the extension mappings from a mime.types file
+// ("type ext1 ext2 ..." per line), overriding the builtin tables.
+func loadMimeTypes(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			if err := mime.AddExtensionType("."+strings.TrimPrefix(ext, "."), fields[0]); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, n+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// paramChunkLen is the maximum length of a parameter value segment so that
+// each folded header line stays within the 78 character limit.
+const paramChunkLen = 60
+
+// encodeParam returns the attribute=value segments for a MIME parameter.
+// Short ASCII values are written as a single quoted-string. Long values are
+// split into RFC 2231 continuations, and non-ASCII values use the RFC 2231
+// extended syntax preceded by an RFC 2047 encoded-word for legacy clients.
+func encodeParam(name, value string) []string {
+	if isPrintableASCII(value) {
+		if len(value) <= paramChunkLen {
+			return []string{name + "=" + quoteParam(value)}
+		}
+		var params []string
+		for i := 0; len(value) > 0; i++ {
+			n := min(len(value), paramChunkLen)
+			params = append(params, fmt.Sprintf("%s*%d=%s", name, i, quoteParam(value[:n])))
+			value = value[n:]
+		}
+		return params
+	}
+
+	// Fold between encoded-words; the whitespace is ignored when decoding
+	fallback := strings.ReplaceAll(mime.BEncoding.Encode("UTF-8", value), "?= =?", "?=\r\n =?")
+	params := []string{name + "=\"" + fallback + "\""}
+	encoded := "UTF-8''" + percentEncodeParam(value)
+	if len(encoded) <= paramChunkLen {
+		return append(params, name+"*="+encoded)
+	}
+	for i := 0; len(encoded) > 0; i++ {
+		n := min(len(encoded), paramChunkLen)
+		// Never split a %XX escape across two segments
+		if p := strings.LastIndexByte(encoded[:n], '%'); p >= 0 && p > n-3 && n < len(encoded) {
+			n = p
+		}
+		params = append(params, fmt.Sprintf("%s*%d*=%s", name, i, encoded[:n]))
+		encoded = encoded[n:]
+	}
+	return params
+}
+
+// writeParamHeader writes a header with parameters, folding each parameter
+// onto its own line when the header would otherwise exceed 78 characters.
+func writeParamHeader(buf *strings.Builder, name, value string, params []string) {
+	line := name + ": " + value
+	for _, p := range params {
+		line += "; " + p
+	}
+	if len(line) <= 78 {
+		buf.WriteString(line + "\r\n")
+		return
+	}
+	buf.WriteString(name + ": " + value)
+	for _, p := range params {
+		buf.WriteString(";\r\n " + p)
+	}
+	buf.WriteString("\r\n")
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteParam returns value as an RFC 2045 quoted-string.
+func quoteParam(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(value[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// percentEncodeParam escapes every byte that is not an RFC 2231
+// attribute-char.
+func percentEncodeParam(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
 func getHostname() string {
 	hostname, _ := os.Hostname()
 	if hostname == "" {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestMessageBody checks the MIME tree built for every combination of
+// bodies, inline images and attachments against testdata/mime/*.golden.
+func TestMessageBody(t *testing.T) {
+	hostname := getHostname()
+	defer func(f func() string) { uniqueID = f }(uniqueID)
+
+	bodies := []struct {
+		name        string
+		plain, html string
+	}{
+		{"plain", "Hello,\r\nsee the logo.\r\n", ""},
+		{"html", "", `<p>Hello,<br><img src="cid:logo.png"></p>`},
+		{"plain-html", "Hello,\r\nsee the logo.\r\n", `<p>Hello,<br><img src="cid:logo.png"></p>`},
+	}
+	for _, body := range bodies {
+		for _, inline := range []bool{false, true} {
+			for _, attach := range []bool{false, true} {
+				name := body.name
+				if inline {
+					name += "-inline"
+				}
+				if attach {
+					name += "-attach"
+				}
+				t.Run(name, func(t *testing.T) {
+					count := 0
+					uniqueID = func() string {
+						count++
+						return fmt.Sprintf("test.%d", count)
+					}
+					config := &Config{
+						BodyPlain:    body.plain,
+						BodyHTML:     body.html,
+						Charset:      "UTF-8",
+						TextEncoding: "quoted-printable",
+					}
+					if inline {
+						config.AttachInline = []string{"testdata/mime/logo.png"}
+					}
+					if attach {
+						config.Attach = []string{"testdata/mime/notes.txt"}
+					}
+
+					part, err := messageBody(config, nil, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var buf strings.Builder
+					if err := part(&buf); err != nil {
+						t.Fatal(err)
+					}
+					got := strings.ReplaceAll(buf.String(), "@"+hostname, "@example.com")
+
+					golden := filepath.Join("testdata", "mime", name+".golden")
+					if *update {
+						if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+							t.Fatal(err)
+						}
+					}
+					want, err := os.ReadFile(golden)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got != string(want) {
+						t.Errorf("message body differs from %s:\n%s", golden, got)
+					}
+				})
+			}
+		}
+	}
+}
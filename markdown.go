@@ -0,0 +1,669 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// markdownRenderer converts Markdown to HTML. It covers the CommonMark
+// block and inline constructs used in practice (headings, paragraphs, lists,
+// block quotes, code, rules, emphasis, links and images, including reference
+// links) plus the GitHub extensions tables, strikethrough and bare URL
+// autolinks. Raw HTML in the source is escaped, not passed through, and
+// link and image URLs with schemes other than those in safeURLSchemes are
+// dropped.
+type markdownRenderer struct {
+	refs map[string]markdownLink
+}
+
+type markdownLink struct {
+	url   string
+	title string
+}
+
+var (
+	mdATXHeading  = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRule        = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence       = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`\\s]*)")
+	mdListItem    = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])(?:([ \t]+)(.*))?$`)
+	mdSetext      = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdTableDelim  = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(?:\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	mdLinkRefDef  = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:[ \t]*<?([^\s>]+)>?(?:[ \t]+(?:"([^"]*)"|'([^']*)'|\(([^)]*)\)))?[ \t]*$`)
+	mdAutolink    = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*|[^\s<>@]+@[^\s<>@]+\.[^\s<>@]+)>`)
+	mdBareURL     = regexp.MustCompile(`^(?:https?://|www\.)[^\s<]*[^\s<.,:;"')\]!?*_~]`)
+	mdLinkDest    = regexp.MustCompile(`^\(\s*(<[^>]*>|[^\s()]*(?:\([^\s()]*\)[^\s()]*)*)(?:\s+(?:"([^"]*)"|'([^']*)'|\(([^)]*)\)))?\s*\)`)
+	mdPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+)
+
+// renderMarkdown returns the HTML for a Markdown document.
+func renderMarkdown(src string) string {
+	src = strings.ReplaceAll(normalizeCRLF(src), "\r\n", "\n")
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(src, "\n"), "\n") {
+		lines = append(lines, expandLeadingTabs(line))
+	}
+
+	r := &markdownRenderer{refs: map[string]markdownLink{}}
+	lines = r.collectReferences(lines)
+	return r.blocks(lines, false)
+}
+
+// expandLeadingTabs replaces tabs in the indentation with spaces, using tab
+// stops of 4 columns.
+func expandLeadingTabs(line string) string {
+	col := 0
+	for i, c := range line {
+		switch c {
+		case ' ':
+			col++
+		case '\t':
+			col += 4 - col%4
+		default:
+			return strings.Repeat(" ", col) + line[i:]
+		}
+	}
+	return strings.Repeat(" ", col)
+}
+
+// collectReferences removes link reference definitions outside of code
+// blocks and records them for use by reference links.
+func (r *markdownRenderer) collectReferences(lines []string) []string {
+	var out []string
+	fence := ""
+	for i, line := range lines {
+		if m := mdFence.FindStringSubmatch(line); m != nil && (fence == "" || strings.HasPrefix(strings.TrimSpace(line), fence)) {
+			if fence == "" {
+				fence = m[2]
+			} else {
+				fence = ""
+			}
+		}
+		if fence == "" && (i == 0 || strings.TrimSpace(lines[i-1]) == "" || mdLinkRefDef.MatchString(lines[i-1])) {
+			if m := mdLinkRefDef.FindStringSubmatch(line); m != nil {
+				key := normalizeLinkLabel(m[1])
+				if _, ok := r.refs[key]; !ok {
+					r.refs[key] = markdownLink{url: m[2], title: m[3] + m[4] + m[5]}
+				}
+				continue
+			}
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func normalizeLinkLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// blocks renders a sequence of block-level lines. In a tight list item,
+// paragraphs are rendered without <p> tags.
+func (r *markdownRenderer) blocks(lines []string, tight bool) string {
+	var out strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			indent, fence := len(m[1]), m[2]
+			var code []string
+			for i++; i < len(lines); i++ {
+				if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, trimIndent(lines[i], indent))
+			}
+			out.WriteString(codeBlock(code, m[3]))
+
+		case indentOf(line) >= 4:
+			var code []string
+			for ; i < len(lines) && (indentOf(lines[i]) >= 4 || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, trimIndent(lines[i], 4))
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			out.WriteString(codeBlock(code, ""))
+
+		case mdATXHeading.MatchString(line):
+			m := mdATXHeading.FindStringSubmatch(line)
+			level := len(m[1])
+			out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, r.inline(m[2]), level))
+			i++
+
+		case mdRule.MatchString(line):
+			out.WriteString("<hr>\n")
+			i++
+
+		case strings.HasPrefix(trimmed, ">") && indentOf(line) < 4:
+			var quote []string
+			for ; i < len(lines); i++ {
+				t := strings.TrimLeft(lines[i], " ")
+				if strings.HasPrefix(t, ">") {
+					t = strings.TrimPrefix(t[1:], " ")
+				} else if strings.TrimSpace(lines[i]) == "" || r.startsBlock(lines[i]) {
+					break
+				}
+				// Lines without ">" continue the quoted paragraph
+				quote = append(quote, t)
+			}
+			out.WriteString("<blockquote>\n" + r.blocks(quote, false) + "</blockquote>\n")
+
+		case mdListItem.MatchString(line):
+			var html string
+			html, i = r.list(lines, i)
+			out.WriteString(html)
+
+		case i+1 < len(lines) && strings.Contains(line, "|") && mdTableDelim.MatchString(lines[i+1]) &&
+			len(splitTableRow(line)) == len(splitTableRow(lines[i+1])):
+			var html string
+			html, i = r.table(lines, i)
+			out.WriteString(html)
+
+		default:
+			var para []string
+			level := 0
+			for ; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) == "" {
+					break
+				}
+				if len(para) > 0 {
+					if m := mdSetext.FindStringSubmatch(lines[i]); m != nil {
+						level = 2
+						if m[1][0] == '=' {
+							level = 1
+						}
+						i++
+						break
+					}
+					if r.startsBlock(lines[i]) {
+						break
+					}
+				}
+				para = append(para, strings.TrimLeft(lines[i], " "))
+			}
+			text := r.inline(strings.TrimRight(strings.Join(para, "\n"), " \t"))
+			switch {
+			case level > 0:
+				out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, text, level))
+			case tight:
+				out.WriteString(text + "\n")
+			default:
+				out.WriteString("<p>" + text + "</p>\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func (r *markdownRenderer) startsBlock(line string) bool {
+	if indentOf(line) >= 4 {
+		return false
+	}
+	if m := mdListItem.FindStringSubmatch(line); m != nil && m[4] != "" {
+		return true
+	}
+	return mdFence.MatchString(line) || mdATXHeading.MatchString(line) || mdRule.MatchString(line) ||
+		strings.HasPrefix(strings.TrimSpace(line), ">")
+}
+
+// list renders the list starting at lines[start] and returns the index of
+// the first line after it.
+func (r *markdownRenderer) list(lines []string, start int) (string, int) {
+	first := mdListItem.FindStringSubmatch(lines[start])
+	marker := first[2]
+	ordered := marker[0] >= '0' && marker[0] <= '9'
+	sameType := func(m string) bool {
+		if ordered {
+			return m[0] >= '0' && m[0] <= '9' && m[len(m)-1] == marker[len(marker)-1]
+		}
+		return m == marker
+	}
+
+	var items [][]string
+	loose := false
+	i := start
+	for i < len(lines) {
+		m := mdListItem.FindStringSubmatch(lines[i])
+		if m == nil || !sameType(m[2]) {
+			break
+		}
+		markerIndent := len(m[1])
+		contentIndent := markerIndent + len(m[2]) + len(m[3])
+		if len(m[3]) > 4 || m[4] == "" {
+			// Content starting with an indented code block, or an empty
+			// first line, is indented by one space after the marker
+			contentIndent = markerIndent + len(m[2]) + 1
+		}
+		item := []string{strings.Repeat(" ", max(len(m[3])-(contentIndent-markerIndent-len(m[2])), 0)) + m[4]}
+
+		blank := false
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				blank = true
+				item = append(item, "")
+				continue
+			}
+			indent := indentOf(line)
+			if indent > markerIndent && (blank || indent >= contentIndent || !mdListItem.MatchString(line)) {
+				if blank && len(item) > 0 {
+					loose = loose || indent >= contentIndent && !mdListItem.MatchString(trimIndent(line, contentIndent))
+				}
+				item = append(item, trimIndent(line, min(indent, contentIndent)))
+				blank = false
+				continue
+			}
+			if !blank && !r.startsBlock(line) && !mdListItem.MatchString(line) {
+				// Lazy continuation of the item's paragraph
+				item = append(item, strings.TrimLeft(line, " "))
+				continue
+			}
+			break
+		}
+		for len(item) > 0 && item[len(item)-1] == "" {
+			item = item[:len(item)-1]
+		}
+		items = append(items, item)
+		if blank && i < len(lines) {
+			if m := mdListItem.FindStringSubmatch(lines[i]); m != nil && sameType(m[2]) {
+				loose = true
+			}
+		}
+	}
+
+	var out strings.Builder
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if n, _ := strconv.Atoi(marker[:len(marker)-1]); n != 1 {
+			out.WriteString(fmt.Sprintf("<ol start=\"%d\">\n", n))
+		} else {
+			out.WriteString("<ol>\n")
+		}
+	} else {
+		out.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		body := r.blocks(item, !loose)
+		if !loose && !strings.Contains(strings.TrimSuffix(body, "\n"), "\n") {
+			body = strings.TrimSuffix(body, "\n")
+		} else {
+			body = "\n" + body
+		}
+		out.WriteString("<li>" + body + "</li>\n")
+	}
+	out.WriteString("</" + tag + ">\n")
+	return out.String(), i
+}
+
+// table renders a GitHub-style table starting at lines[start] and returns
+// the index of the first line after it.
+func (r *markdownRenderer) table(lines []string, start int) (string, int) {
+	header := splitTableRow(lines[start])
+	var align []string
+	for _, cell := range splitTableRow(lines[start+1]) {
+		switch {
+		case strings.HasPrefix(cell, ":") && strings.HasSuffix(cell, ":"):
+			align = append(align, "center")
+		case strings.HasSuffix(cell, ":"):
+			align = append(align, "right")
+		case strings.HasPrefix(cell, ":"):
+			align = append(align, "left")
+		default:
+			align = append(align, "")
+		}
+	}
+
+	row := func(cells []string, tag string) string {
+		var b strings.Builder
+		b.WriteString("<tr>\n")
+		for c := range header {
+			cell := ""
+			if c < len(cells) {
+				cell = cells[c]
+			}
+			if align[c] != "" {
+				b.WriteString(fmt.Sprintf("<%s style=\"text-align: %s\">", tag, align[c]))
+			} else {
+				b.WriteString("<" + tag + ">")
+			}
+			b.WriteString(r.inline(cell) + "</" + tag + ">\n")
+		}
+		b.WriteString("</tr>\n")
+		return b.String()
+	}
+
+	var out strings.Builder
+	out.WriteString("<table>\n<thead>\n" + row(header, "th") + "</thead>\n")
+	i := start + 2
+	if i < len(lines) && strings.TrimSpace(lines[i]) != "" && !r.startsBlock(lines[i]) {
+		out.WriteString("<tbody>\n")
+		for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && !r.startsBlock(lines[i]); i++ {
+			out.WriteString(row(splitTableRow(lines[i]), "td"))
+		}
+		out.WriteString("</tbody>\n")
+	}
+	out.WriteString("</table>\n")
+	return out.String(), i
+}
+
+// splitTableRow splits a table row into its trimmed cells at pipes that are
+// not escaped or inside a code span.
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	inCode := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case c == '`':
+			inCode = !inCode
+			cell.WriteByte(c)
+		case c == '|' && !inCode:
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(c)
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func codeBlock(lines []string, lang string) string {
+	class := ""
+	if lang != "" {
+		class = fmt.Sprintf(" class=\"language-%s\"", html.EscapeString(lang))
+	}
+	code := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		code += "\n"
+	}
+	return "<pre><code" + class + ">" + html.EscapeString(code) + "</code></pre>\n"
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// trimIndent removes up to n leading spaces.
+func trimIndent(line string, n int) string {
+	return line[min(indentOf(line), n):]
+}
+
+// inline renders the inline content of a block.
+func (r *markdownRenderer) inline(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		rest := text[i:]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(mdPunctuation, text[i+1]) >= 0:
+			out.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && strings.HasPrefix(rest, "\\\n"):
+			out.WriteString("<br>\n")
+			i += 2
+			continue
+
+		case c == '\n':
+			// Two trailing spaces make a hard line break
+			s := strings.TrimRight(out.String(), " ")
+			if len(out.String())-len(s) >= 2 {
+				out.Reset()
+				out.WriteString(s + "<br>\n")
+			} else {
+				out.Reset()
+				out.WriteString(s + "\n")
+			}
+			i++
+			for i < len(text) && text[i] == ' ' {
+				i++
+			}
+			continue
+
+		case c == '`':
+			n := len(rest) - len(strings.TrimLeft(rest, "`"))
+			run := rest[:n]
+			if end := findCodeSpanEnd(rest[n:], run); end >= 0 {
+				code := strings.ReplaceAll(rest[n:n+end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += n + end + n
+			} else {
+				out.WriteString(run)
+				i += n
+			}
+			continue
+
+		case c == '<':
+			if m := mdAutolink.FindStringSubmatch(rest); m != nil {
+				href := m[1]
+				if !strings.Contains(href, ":") {
+					href = "mailto:" + href
+				}
+				out.WriteString(fmt.Sprintf("<a%s>%s</a>", urlAttr("href", href), html.EscapeString(m[1])))
+				i += len(m[0])
+				continue
+			}
+
+		case c == '!' && strings.HasPrefix(rest, "!["):
+			if link, label, n := r.parseLink(rest[1:]); n > 0 {
+				out.WriteString(fmt.Sprintf("<img%s alt=\"%s\"", urlAttr("src", link.url), html.EscapeString(stripMarkdown(label))))
+				if link.title != "" {
+					out.WriteString(fmt.Sprintf(" title=\"%s\"", html.EscapeString(link.title)))
+				}
+				out.WriteString(">")
+				i += 1 + n
+				continue
+			}
+
+		case c == '[':
+			if link, label, n := r.parseLink(rest); n > 0 {
+				out.WriteString("<a" + urlAttr("href", link.url))
+				if link.title != "" {
+					out.WriteString(fmt.Sprintf(" title=\"%s\"", html.EscapeString(link.title)))
+				}
+				out.WriteString(">" + r.inline(label) + "</a>")
+				i += n
+				continue
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			if html, n := r.emphasis(text, i); n > 0 {
+				out.WriteString(html)
+				i += n
+				continue
+			}
+
+		case c == 'h' || c == 'w':
+			if i == 0 || !isWordByte(text[i-1]) {
+				if url := mdBareURL.FindString(rest); url != "" {
+					href := url
+					if strings.HasPrefix(url, "www.") {
+						href = "http://" + url
+					}
+					out.WriteString(fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(href), html.EscapeString(url)))
+					i += len(url)
+					continue
+				}
+			}
+		}
+		out.WriteString(html.EscapeString(string(c)))
+		i++
+	}
+	return out.String()
+}
+
+// findCodeSpanEnd returns the offset of the backtick run that closes a code
+// span opened by run, or -1.
+func findCodeSpanEnd(s, run string) int {
+	for i := 0; i < len(s); {
+		j := strings.Index(s[i:], run)
+		if j < 0 {
+			return -1
+		}
+		j += i
+		end := j + len(run)
+		if (j == 0 || s[j-1] != '`') && (end == len(s) || s[end] != '`') {
+			return j
+		}
+		for end < len(s) && s[end] == '`' {
+			end++
+		}
+		i = end
+	}
+	return -1
+}
+
+// parseLink parses an inline link "[label](url "title")" or a reference
+// link "[label][ref]", "[label][]" or "[label]" at the start of s. It returns
+// the number of bytes consumed, or 0 if s does not start with a link.
+func (r *markdownRenderer) parseLink(s string) (markdownLink, string, int) {
+	depth := 0
+	end := -1
+	for i := 0; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '`':
+			if j := findCodeSpanEnd(s[i+1:], "`"); j >= 0 {
+				i += j + 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return markdownLink{}, "", 0
+	}
+	label := s[1:end]
+	rest := s[end+1:]
+
+	if m := mdLinkDest.FindStringSubmatch(rest); m != nil {
+		url := strings.TrimSuffix(strings.TrimPrefix(m[1], "<"), ">")
+		return markdownLink{url: url, title: m[2] + m[3] + m[4]}, label, end + 1 + len(m[0])
+	}
+	ref, n := label, end+1
+	if strings.HasPrefix(rest, "[") {
+		if j := strings.IndexByte(rest, ']'); j >= 0 {
+			if j > 1 {
+				ref = rest[1:j]
+			}
+			n += j + 1
+		}
+	}
+	if link, ok := r.refs[normalizeLinkLabel(ref)]; ok {
+		return link, label, n
+	}
+	return markdownLink{}, "", 0
+}
+
+// emphasis renders *em*, **strong**, _em_, __strong__ or ~~strikethrough~~
+// starting at text[i], returning the HTML and the number of bytes consumed.
+func (r *markdownRenderer) emphasis(text string, i int) (string, int) {
+	c := text[i]
+	n := 1
+	for i+n < len(text) && text[i+n] == c && n < 3 {
+		n++
+	}
+	if c == '~' && n != 2 {
+		return "", 0
+	}
+	open := i + n
+	if open >= len(text) || text[open] == ' ' || text[open] == '\n' {
+		return "", 0
+	}
+	// Underscores inside words are literal
+	if c == '_' && i > 0 && isWordByte(text[i-1]) {
+		return "", 0
+	}
+
+	delim := text[i:open]
+	for j := open + 1; j <= len(text)-n; j++ {
+		if text[j] == '`' {
+			if k := findCodeSpanEnd(text[j+1:], "`"); k >= 0 {
+				j += k + 1
+				continue
+			}
+		}
+		if text[j] == '\\' {
+			j++
+			continue
+		}
+		if text[j:j+n] != delim || text[j-1] == ' ' || text[j-1] == '\n' {
+			continue
+		}
+		if c == '_' && j+n < len(text) && isWordByte(text[j+n]) {
+			continue
+		}
+		if j+n < len(text) && text[j+n] == c {
+			// Part of a longer run, e.g. the end of ***nested***
+			if n < 3 {
+				continue
+			}
+		}
+		inner := r.inline(text[open:j])
+		switch {
+		case c == '~':
+			return "<del>" + inner + "</del>", j + n - i
+		case n == 1:
+			return "<em>" + inner + "</em>", j + n - i
+		case n == 2:
+			return "<strong>" + inner + "</strong>", j + n - i
+		default:
+			return "<em><strong>" + inner + "</strong></em>", j + n - i
+		}
+	}
+	return "", 0
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// urlAttr renders a URL attribute, or nothing for a URL with an unsafe
+// scheme such as javascript:, which leaves an inert link or image.
+func urlAttr(name, url string) string {
+	if !isSafeURL(url) {
+		return ""
+	}
+	return fmt.Sprintf(" %s=\"%s\"", name, html.EscapeString(url))
+}
+
+// stripMarkdown removes emphasis markers from image alt text.
+func stripMarkdown(s string) string {
+	return strings.NewReplacer("**", "", "__", "", "*", "", "`", "").Replace(s)
+}
+
+// markdownDocument wraps rendered Markdown in an HTML document.
+func markdownDocument(body, charset string) string {
+	return "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"" + html.EscapeString(charset) + "\">\n</head>\n<body>\n" +
+		body + "</body>\n</html>\n"
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mergeRow is one recipient of a mail merge: the template variables from
+// the merge file plus the original CSV record, if any, for the results file.
+type mergeRow struct {
+	vars   map[string]any
+	record []string
+}
+
+// runMerge sends one message per row of --merge-file. Each row supplies the
+// To address (and optionally Cc/Bcc) and the template variables for that
+// message; all messages go over one session.
+// The outcome of every row is written to the results CSV so that failed rows
+// can be extracted and sent again.
+func runMerge(config *Config) error {
+	columns, rows, err := loadMergeFile(config.MergeFile)
+	if err != nil {
+		return fmt.Errorf("failed to load merge file: %w", err)
+	}
+	if config.Server == "" && !config.PrintOnly {
+		return fmt.Errorf("--merge-file requires --server")
+	}
+
+	resultsFile := config.MergeResults
+	if resultsFile == "" {
+		resultsFile = strings.TrimSuffix(config.MergeFile, filepath.Ext(config.MergeFile)) + ".results.csv"
+	}
+	f, err := os.Create(resultsFile)
+	if err != nil {
+		return fmt.Errorf("failed to create results file: %w", err)
+	}
+	defer f.Close()
+	results := csv.NewWriter(f)
+	if columns == nil {
+		columns = []string{"to"}
+	}
+	results.Write(append(append([]string{}, columns...), "status", "error"))
+
+	failed := 0
+	deliverAll(config, len(rows), func(i int) (*outgoingMessage, error) {
+		rowConfig, err := mergeConfig(config, rows[i])
+		if err != nil {
+			return nil, err
+		}
+		return buildMessage(rowConfig)
+	}, func(i int, err error) {
+		record := rows[i].record
+		if record == nil {
+			to, _ := lookupFold(rows[i].vars, "to")
+			addrs, _ := mergeAddresses(to)
+			record = []string{strings.Join(addrs, ", ")}
+		}
+		status, errText := "sent", ""
+		if err != nil {
+			failed++
+			status, errText = "failed", err.Error()
+		}
+		if config.Verbose > 0 || err != nil {
+			fmt.Fprintf(os.Stderr, "row %d: %s %s\n", i+1, status, errText)
+		}
+		results.Write(append(append([]string{}, record...), status, errText))
+		results.Flush()
+	})
+
+	if err := results.Error(); err != nil {
+		return fmt.Errorf("failed to write results file: %w", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages failed, see %s", failed, len(rows), resultsFile)
+	}
+	return nil
+}
+
+// mergeConfig returns a copy of config for a single merge row. The row's
+// To replaces --to, its Cc and Bcc are added to --cc and --bcc.
+func mergeConfig(config *Config, row mergeRow) (*Config, error) {
+	c := *config
+	c.To = nil
+	c.Cc = append([]string(nil), config.Cc...)
+	c.Bcc = append([]string(nil), config.Bcc...)
+	c.MergeRow = row.vars
+
+	for key, value := range row.vars {
+		var list *[]string
+		switch strings.ToLower(key) {
+		case "to":
+			list = &c.To
+		case "cc":
+			list = &c.Cc
+		case "bcc":
+			list = &c.Bcc
+		default:
+			continue
+		}
+		addrs, err := mergeAddresses(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s column: %w", key, err)
+		}
+		for _, a := range addrs {
+			if err := appendAddresses(list, a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(c.To) == 0 {
+		return nil, fmt.Errorf("no To address")
+	}
+	if err := validateAddresses(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// mergeAddresses accepts an address column given as a string or, in JSON
+// merge files, as a list of strings.
+func mergeAddresses(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []any:
+		var addrs []string
+		for _, a := range v {
+			s, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %v", a)
+			}
+			addrs = append(addrs, s)
+		}
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("expected a string or a list of strings, got %v", value)
+}
+
+// loadMergeFile reads a merge file. CSV files must have a header row naming
+// the columns; JSON files contain an array of objects. A "to" column or key
+// is required.
+func loadMergeFile(filename string) ([]string, []mergeRow, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(filename), ".json") || strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		var objects []map[string]any
+		if err := json.Unmarshal(data, &objects); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		rows := make([]mergeRow, 0, len(objects))
+		for i, obj := range objects {
+			if _, ok := lookupFold(obj, "to"); !ok {
+				return nil, nil, fmt.Errorf("%s: entry %d has no \"to\" key", filename, i+1)
+			}
+			rows = append(rows, mergeRow{vars: obj})
+		}
+		return nil, rows, nil
+	}
+
+	r := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(data), "\ufeff")))
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("%s: missing header row", filename)
+	}
+	columns := records[0]
+	for i, c := range columns {
+		columns[i] = strings.TrimSpace(c)
+	}
+	hasTo := false
+	for _, c := range columns {
+		hasTo = hasTo || strings.EqualFold(c, "to")
+	}
+	if !hasTo {
+		return nil, nil, fmt.Errorf("%s: no \"to\" column", filename)
+	}
+
+	rows := make([]mergeRow, 0, len(records)-1)
+	for _, record := range records[1:] {
+		vars := make(map[string]any, len(columns))
+		for i, c := range columns {
+			vars[c] = record[i]
+		}
+		rows = append(rows, mergeRow{vars: vars, record: record})
+	}
+	return columns, rows, nil
+}
+
+// lookupFold returns the value of key in m, ignoring case.
+func lookupFold(m map[string]any, key string) (any, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
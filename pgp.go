@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// OpenPGP (RFC 4880) support for PGP/MIME (RFC 3156). Only what is needed to
+// sign and encrypt with version 4 keys read from local armored files is
+// implemented: RSA and EdDSA (Ed25519) signing keys, RSA and ECDH
+// (Curve25519) encryption keys, AES-256 with MDC for the message itself.
+
+const (
+	pgpTagPKESK       = 1
+	pgpTagSignature   = 2
+	pgpTagSecretKey   = 5
+	pgpTagPublicKey   = 6
+	pgpTagSecretSub   = 7
+	pgpTagLiteral     = 11
+	pgpTagPublicSub   = 14
+	pgpTagSEIPD       = 18
+	pgpTagMDC         = 19
+	pgpAlgoRSA        = 1
+	pgpAlgoRSAEncrypt = 2
+	pgpAlgoRSASign    = 3
+	pgpAlgoECDH       = 18
+	pgpAlgoEdDSA      = 22
+	pgpHashSHA256     = 8
+	pgpCipherAES128   = 7
+	pgpCipherAES192   = 8
+	pgpCipherAES256   = 9
+	pgpFlagSign       = 0x02
+	pgpFlagEncrypt    = 0x0c
+)
+
+var (
+	pgpOIDEd25519    = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+	pgpOIDCurve25519 = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+)
+
+// pgpKey is a primary key or subkey.
+type pgpKey struct {
+	algo        byte
+	created     time.Time
+	body        []byte // public key packet body, used for the fingerprint
+	fingerprint []byte
+	keyID       []byte
+
+	rsa       *rsa.PublicKey
+	point     []byte // EdDSA/ECDH public point including the 0x40 prefix
+	oid       []byte
+	kdfHash   byte
+	kdfCipher byte
+
+	flags    byte
+	hasFlags bool
+	expires  time.Time
+	revoked  bool
+
+	secret []byte // secret key material as stored in the packet
+	signer crypto.Signer
+}
+
+// pgpEntity is a primary key with its subkeys and user IDs.
+type pgpEntity struct {
+	primary *pgpKey
+	subkeys []*pgpKey
+	userIDs []string
+}
+
+func (k *pgpKey) canSign() bool {
+	if k.hasFlags {
+		return k.flags&pgpFlagSign != 0
+	}
+	return k.algo == pgpAlgoRSA || k.algo == pgpAlgoRSASign || k.algo == pgpAlgoEdDSA
+}
+
+func (k *pgpKey) canEncrypt() bool {
+	if k.hasFlags {
+		return k.flags&pgpFlagEncrypt != 0
+	}
+	return k.algo == pgpAlgoRSA || k.algo == pgpAlgoRSAEncrypt || k.algo == pgpAlgoECDH
+}
+
+func (k *pgpKey) usable() bool {
+	return !k.revoked && (k.expires.IsZero() || time.Now().Before(k.expires))
+}
+
+// pgpWrap signs and/or encrypts the MIME entity of message as PGP/MIME
+// according to the --pgp-* options.
+func pgpWrap(config *Config, message string) (string, error) {
+	outer, entity := splitMIMEEntity(message)
+
+	if config.PGPSignKey != "" {
+		entities, err := readPGPKeyring(config.PGPSignKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to load PGP signing key: %w", err)
+		}
+		key, err := pgpSigningKey(entities, config.PGPPassphrase)
+		if err != nil {
+			return "", fmt.Errorf("failed to load PGP signing key: %w", err)
+		}
+		// The CRLF before the next boundary is not part of the signed content
+		entity = strings.TrimSuffix(entity, "\r\n")
+		signature, err := pgpSign([]byte(entity), key)
+		if err != nil {
+			return "", fmt.Errorf("PGP signing failed: %w", err)
+		}
+
+		boundary := "----=_Signed_" + uniqueID()
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("Content-Type: multipart/signed; micalg=pgp-sha256;\r\n protocol=\"application/pgp-signature\"; boundary=\"%s\"\r\n\r\n", boundary))
+		b.WriteString("This is an OpenPGP/MIME signed message (RFC 3156).\r\n\r\n")
+		b.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		b.WriteString(entity + "\r\n")
+		b.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		b.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+		b.WriteString("Content-Description: OpenPGP digital signature\r\n")
+		b.WriteString("Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n")
+		b.WriteString(pgpArmor("PGP SIGNATURE", signature))
+		b.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+		entity = b.String()
+	}
+
+	if len(config.PGPEncryptKey) > 0 {
+		var recipients []*pgpKey
+		for _, filename := range config.PGPEncryptKey {
+			entities, err := readPGPKeyring(filename)
+			if err != nil {
+				return "", fmt.Errorf("failed to load PGP recipient key: %w", err)
+			}
+			for _, e := range entities {
+				key, err := pgpEncryptionKey(e)
+				if err != nil {
+					return "", fmt.Errorf("%s: %w", filename, err)
+				}
+				recipients = append(recipients, key)
+			}
+		}
+		encrypted, err := pgpEncrypt([]byte(entity), recipients)
+		if err != nil {
+			return "", fmt.Errorf("PGP encryption failed: %w", err)
+		}
+
+		boundary := "----=_Encrypted_" + uniqueID()
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("Content-Type: multipart/encrypted;\r\n protocol=\"application/pgp-encrypted\"; boundary=\"%s\"\r\n\r\n", boundary))
+		b.WriteString("This is an OpenPGP/MIME encrypted message (RFC 3156).\r\n\r\n")
+		b.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		b.WriteString("Content-Type: application/pgp-encrypted\r\n")
+		b.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+		b.WriteString("Version: 1\r\n\r\n")
+		b.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		b.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+		b.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+		b.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+		b.WriteString(pgpArmor("PGP MESSAGE", encrypted))
+		b.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+		entity = b.String()
+	}
+
+	return outer + entity, nil
+}
+
+// pgpSigningKey returns the first usable signing key with secret material,
+// unlocking it with passphrase if it is protected.
+func pgpSigningKey(entities []*pgpEntity, passphrase string) (*pgpKey, error) {
+	for _, e := range entities {
+		for _, k := range append([]*pgpKey{e.primary}, e.subkeys...) {
+			if k.secret == nil || !k.canSign() || !k.usable() || k.algo == pgpAlgoECDH {
+				continue
+			}
+			if err := k.unlock(passphrase); err != nil {
+				if errors.Is(err, errPGPNoSecret) {
+					continue
+				}
+				return nil, err
+			}
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("no usable secret signing key found")
+}
+
+// pgpEncryptionKey returns the newest usable encryption subkey of e, or the
+// primary key if it can encrypt itself.
+func pgpEncryptionKey(e *pgpEntity) (*pgpKey, error) {
+	if !e.primary.usable() {
+		return nil, fmt.Errorf("key %X is revoked or expired", e.primary.keyID)
+	}
+	var best *pgpKey
+	for _, k := range append([]*pgpKey{e.primary}, e.subkeys...) {
+		if !k.canEncrypt() || !k.usable() {
+			continue
+		}
+		if k.algo != pgpAlgoRSA && k.algo != pgpAlgoRSAEncrypt && k.algo != pgpAlgoECDH {
+			continue
+		}
+		if best == nil || k.created.After(best.created) {
+			best = k
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no usable encryption key found for %X", e.primary.keyID)
+	}
+	return best, nil
+}
+
+// pgpSign returns a binary document signature packet over data.
+func pgpSign(data []byte, key *pgpKey) ([]byte, error) {
+	var hashed bytes.Buffer
+	hashed.Write(pgpSubpacket(2, binary.BigEndian.AppendUint32(nil, uint32(time.Now().Unix()))))
+	hashed.Write(pgpSubpacket(33, append([]byte{4}, key.fingerprint...)))
+	unhashed := pgpSubpacket(16, key.keyID)
+
+	var sig bytes.Buffer
+	sig.Write([]byte{4, 0x00, key.algo, pgpHashSHA256})
+	sig.Write(binary.BigEndian.AppendUint16(nil, uint16(hashed.Len())))
+	sig.Write(hashed.Bytes())
+	hashedLen := sig.Len()
+
+	h := sha256.New()
+	h.Write(data)
+	h.Write(sig.Bytes())
+	h.Write([]byte{4, 0xff})
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(hashedLen)))
+	digest := h.Sum(nil)
+
+	sig.Write(binary.BigEndian.AppendUint16(nil, uint16(len(unhashed))))
+	sig.Write(unhashed)
+	sig.Write(digest[:2])
+
+	switch priv := key.signer.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest)
+		if err != nil {
+			return nil, err
+		}
+		sig.Write(pgpMPI(s))
+	case ed25519.PrivateKey:
+		s := ed25519.Sign(priv, digest)
+		sig.Write(pgpMPI(s[:32]))
+		sig.Write(pgpMPI(s[32:]))
+	default:
+		return nil, fmt.Errorf("unsupported signing key algorithm %d", key.algo)
+	}
+	return pgpPacket(pgpTagSignature, sig.Bytes()), nil
+}
+
+// pgpEncrypt returns the session key packets for recipients followed by
+// data as a literal packet in an AES-256 integrity protected data packet.
+func pgpEncrypt(data []byte, recipients []*pgpKey) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	var checksum uint16
+	for _, b := range sessionKey {
+		checksum += uint16(b)
+	}
+	keyBlock := append(append([]byte{pgpCipherAES256}, sessionKey...), byte(checksum>>8), byte(checksum))
+
+	var out bytes.Buffer
+	for _, key := range recipients {
+		pkesk := append([]byte{3}, key.keyID...)
+		pkesk = append(pkesk, key.algo)
+		switch key.algo {
+		case pgpAlgoRSA, pgpAlgoRSAEncrypt:
+			c, err := rsa.EncryptPKCS1v15(rand.Reader, key.rsa, keyBlock)
+			if err != nil {
+				return nil, err
+			}
+			pkesk = append(pkesk, pgpMPI(c)...)
+		case pgpAlgoECDH:
+			fields, err := pgpECDHEncrypt(key, keyBlock)
+			if err != nil {
+				return nil, err
+			}
+			pkesk = append(pkesk, fields...)
+		default:
+			return nil, fmt.Errorf("unsupported encryption key algorithm %d", key.algo)
+		}
+		out.Write(pgpPacket(pgpTagPKESK, pkesk))
+	}
+
+	literal := pgpPacket(pgpTagLiteral, append([]byte{'b', 0, 0, 0, 0, 0}, data...))
+
+	prefix := make([]byte, aes.BlockSize+2)
+	if _, err := rand.Read(prefix[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	copy(prefix[aes.BlockSize:], prefix[aes.BlockSize-2:aes.BlockSize])
+
+	plaintext := append(append(prefix, literal...), 0xd0|pgpTagMDC, 20)
+	mdc := sha1.Sum(plaintext)
+	plaintext = append(plaintext, mdc[:]...)
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCFBEncrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(ciphertext, plaintext)
+	out.Write(pgpPacket(pgpTagSEIPD, append([]byte{1}, ciphertext...)))
+	return out.Bytes(), nil
+}
+
+// pgpECDHEncrypt wraps keyBlock for a Curve25519 ECDH key (RFC 6637) and
+// returns the algorithm specific PKESK fields.
+func pgpECDHEncrypt(key *pgpKey, keyBlock []byte) ([]byte, error) {
+	if !bytes.Equal(key.oid, pgpOIDCurve25519) || len(key.point) != 33 || key.point[0] != 0x40 {
+		return nil, fmt.Errorf("key %X: only Curve25519 ECDH keys are supported", key.keyID)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(key.point[1:])
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var kdfHash func() hash.Hash
+	switch key.kdfHash {
+	case 8:
+		kdfHash = sha256.New
+	case 9:
+		kdfHash = sha512.New384
+	case 10:
+		kdfHash = sha512.New
+	default:
+		return nil, fmt.Errorf("key %X: unsupported KDF hash %d", key.keyID, key.kdfHash)
+	}
+	kekLen := map[byte]int{pgpCipherAES128: 16, pgpCipherAES192: 24, pgpCipherAES256: 32}[key.kdfCipher]
+	if kekLen == 0 {
+		return nil, fmt.Errorf("key %X: unsupported KDF cipher %d", key.keyID, key.kdfCipher)
+	}
+
+	var param bytes.Buffer
+	param.WriteByte(byte(len(key.oid)))
+	param.Write(key.oid)
+	param.Write([]byte{pgpAlgoECDH, 3, 1, key.kdfHash, key.kdfCipher})
+	param.WriteString("Anonymous Sender    ")
+	param.Write(key.fingerprint)
+
+	h := kdfHash()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(shared)
+	h.Write(param.Bytes())
+	kek := h.Sum(nil)[:kekLen]
+
+	padding := 8 - len(keyBlock)%8
+	padded := append(append([]byte{}, keyBlock...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	wrapped, err := aesKeyWrap(kek, padded)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := pgpMPI(append([]byte{0x40}, ephemeral.PublicKey().Bytes()...))
+	fields = append(fields, byte(len(wrapped)))
+	return append(fields, wrapped...), nil
+}
+
+// aesKeyWrap implements the RFC 3394 key wrap algorithm.
+func aesKeyWrap(kek, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(plaintext) / 8
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := append([]byte{}, plaintext...)
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(buf, a)
+			copy(buf[8:], r[i*8:i*8+8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(r[i*8:], buf[8:])
+		}
+	}
+	return append(a, r...), nil
+}
+
+var errPGPNoSecret = errors.New("secret key material is not available")
+
+// unlock decodes the secret key material, decrypting it with passphrase if
+// it is protected.
+func (k *pgpKey) unlock(passphrase string) error {
+	if k.signer != nil {
+		return nil
+	}
+	data := k.secret
+	if len(data) == 0 {
+		return errPGPNoSecret
+	}
+	usage := data[0]
+	data = data[1:]
+
+	var material []byte
+	switch usage {
+	case 0:
+		material = data
+		if len(material) < 2 {
+			return fmt.Errorf("key %X: truncated secret key", k.keyID)
+		}
+		material = material[:len(material)-2]
+	case 254, 255:
+		if len(data) < 2 {
+			return fmt.Errorf("key %X: truncated secret key", k.keyID)
+		}
+		cipherAlgo := data[0]
+		if data[1] == 101 {
+			// GnuPG extension: secret part stored elsewhere (e.g. on a card)
+			return errPGPNoSecret
+		}
+		s2kKey, rest, err := pgpS2K(data[1:], passphrase, cipherAlgo)
+		if err != nil {
+			return fmt.Errorf("key %X: %w", k.keyID, err)
+		}
+		if len(rest) < aes.BlockSize {
+			return fmt.Errorf("key %X: truncated secret key", k.keyID)
+		}
+		block, err := aes.NewCipher(s2kKey)
+		if err != nil {
+			return err
+		}
+		iv, encrypted := rest[:aes.BlockSize], rest[aes.BlockSize:]
+		decrypted := make([]byte, len(encrypted))
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(decrypted, encrypted)
+		if usage == 254 {
+			if len(decrypted) < sha1.Size {
+				return fmt.Errorf("key %X: truncated secret key", k.keyID)
+			}
+			material = decrypted[:len(decrypted)-sha1.Size]
+			sum := sha1.Sum(material)
+			if !bytes.Equal(sum[:], decrypted[len(material):]) {
+				return fmt.Errorf("key %X: wrong passphrase", k.keyID)
+			}
+		} else {
+			if len(decrypted) < 2 {
+				return fmt.Errorf("key %X: truncated secret key", k.keyID)
+			}
+			material = decrypted[:len(decrypted)-2]
+			var sum uint16
+			for _, b := range material {
+				sum += uint16(b)
+			}
+			if sum != binary.BigEndian.Uint16(decrypted[len(material):]) {
+				return fmt.Errorf("key %X: wrong passphrase", k.keyID)
+			}
+		}
+	default:
+		return fmt.Errorf("key %X: unsupported secret key protection %d", k.keyID, usage)
+	}
+
+	switch k.algo {
+	case pgpAlgoRSA, pgpAlgoRSASign:
+		var mpis [][]byte
+		for i := 0; i < 4; i++ {
+			var mpi []byte
+			var err error
+			if mpi, material, err = readMPI(material); err != nil {
+				return fmt.Errorf("key %X: %w", k.keyID, err)
+			}
+			mpis = append(mpis, mpi)
+		}
+		priv := &rsa.PrivateKey{
+			PublicKey: *k.rsa,
+			D:         new(big.Int).SetBytes(mpis[0]),
+			Primes:    []*big.Int{new(big.Int).SetBytes(mpis[1]), new(big.Int).SetBytes(mpis[2])},
+		}
+		if err := priv.Validate(); err != nil {
+			return fmt.Errorf("key %X: %w", k.keyID, err)
+		}
+		priv.Precompute()
+		k.signer = priv
+	case pgpAlgoEdDSA:
+		seed, _, err := readMPI(material)
+		if err != nil {
+			return fmt.Errorf("key %X: %w", k.keyID, err)
+		}
+		if len(seed) > ed25519.SeedSize {
+			return fmt.Errorf("key %X: invalid EdDSA secret key", k.keyID)
+		}
+		seed = append(make([]byte, ed25519.SeedSize-len(seed)), seed...)
+		k.signer = ed25519.NewKeyFromSeed(seed)
+	default:
+		return fmt.Errorf("key %X: unsupported signing key algorithm %d", k.keyID, k.algo)
+	}
+	return nil
+}
+
+// pgpS2K derives a key of the size required by cipherAlgo from passphrase
+// using the string-to-key specifier at the start of data, and returns the
+// remaining data.
+func pgpS2K(data []byte, passphrase string, cipherAlgo byte) ([]byte, []byte, error) {
+	keyLen := map[byte]int{pgpCipherAES128: 16, pgpCipherAES192: 24, pgpCipherAES256: 32}[cipherAlgo]
+	if keyLen == 0 {
+		return nil, nil, fmt.Errorf("unsupported secret key cipher %d", cipherAlgo)
+	}
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("truncated S2K specifier")
+	}
+	s2kType, hashAlgo := data[0], data[1]
+	data = data[2:]
+
+	var newHash func() hash.Hash
+	switch hashAlgo {
+	case 2:
+		newHash = sha1.New
+	case 8:
+		newHash = sha256.New
+	case 9:
+		newHash = sha512.New384
+	case 10:
+		newHash = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported S2K hash %d", hashAlgo)
+	}
+
+	var salt []byte
+	count := 0
+	switch s2kType {
+	case 0:
+	case 1, 3:
+		if len(data) < 8 {
+			return nil, nil, fmt.Errorf("truncated S2K specifier")
+		}
+		salt, data = data[:8], data[8:]
+		if s2kType == 3 {
+			if len(data) < 1 {
+				return nil, nil, fmt.Errorf("truncated S2K specifier")
+			}
+			count = (16 + int(data[0]&15)) << (uint(data[0]>>4) + 6)
+			data = data[1:]
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported S2K type %d", s2kType)
+	}
+
+	input := append(append([]byte{}, salt...), passphrase...)
+	if count < len(input) {
+		count = len(input)
+	}
+	var key []byte
+	for i := 0; len(key) < keyLen; i++ {
+		h := newHash()
+		h.Write(make([]byte, i))
+		for written := 0; written < count; written += len(input) {
+			h.Write(input[:min(len(input), count-written)])
+		}
+		key = h.Sum(key)
+	}
+	return key[:keyLen], data, nil
+}
+
+// readPGPKeyring reads all keys from an ASCII armored (or binary) key file.
+func readPGPKeyring(filename string) ([]*pgpEntity, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var packets []byte
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		blocks, err := pgpDearmor(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		packets = bytes.Join(blocks, nil)
+	} else {
+		packets = data
+	}
+
+	entities, err := parsePGPKeys(packets)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("%s: no OpenPGP keys found", filename)
+	}
+	return entities, nil
+}
+
+// parsePGPKeys groups a packet sequence into entities.
+func parsePGPKeys(data []byte) ([]*pgpEntity, error) {
+	var entities []*pgpEntity
+	var current *pgpEntity
+	var last *pgpKey
+	for len(data) > 0 {
+		tag, body, rest, err := readPGPPacket(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		switch tag {
+		case pgpTagPublicKey, pgpTagSecretKey:
+			key, err := parsePGPKey(body, tag == pgpTagSecretKey)
+			if err != nil {
+				return nil, err
+			}
+			current = &pgpEntity{primary: key}
+			entities = append(entities, current)
+			last = key
+		case pgpTagPublicSub, pgpTagSecretSub:
+			if current == nil {
+				return nil, fmt.Errorf("subkey without primary key")
+			}
+			key, err := parsePGPKey(body, tag == pgpTagSecretSub)
+			if err != nil {
+				return nil, err
+			}
+			current.subkeys = append(current.subkeys, key)
+			last = key
+		case 13:
+			if current != nil {
+				current.userIDs = append(current.userIDs, string(body))
+			}
+		case pgpTagSignature:
+			if last != nil {
+				applyPGPSelfSignature(current, last, body)
+			}
+		}
+	}
+	return entities, nil
+}
+
+// applyPGPSelfSignature records key flags, expiry and revocation from a
+// self-signature. Signatures are not verified: the key files are local and
+// trusted by the user who supplied them.
+func applyPGPSelfSignature(e *pgpEntity, key *pgpKey, body []byte) {
+	if len(body) < 6 || body[0] != 4 {
+		return
+	}
+	sigType := body[1]
+	hashedLen := int(binary.BigEndian.Uint16(body[4:6]))
+	if len(body) < 6+hashedLen {
+		return
+	}
+	switch sigType {
+	case 0x20:
+		e.primary.revoked = true
+		return
+	case 0x28:
+		key.revoked = true
+		return
+	case 0x10, 0x11, 0x12, 0x13, 0x18, 0x1f:
+	default:
+		return
+	}
+
+	subpackets := body[6 : 6+hashedLen]
+	for len(subpackets) > 0 {
+		length, n := pgpSubpacketLength(subpackets)
+		if n == 0 || length == 0 || len(subpackets) < n+length {
+			return
+		}
+		typ, value := subpackets[n]&0x7f, subpackets[n+1:n+length]
+		switch {
+		case typ == 27 && len(value) > 0:
+			key.flags = value[0]
+			key.hasFlags = true
+		case typ == 9 && len(value) == 4:
+			if secs := binary.BigEndian.Uint32(value); secs != 0 {
+				key.expires = key.created.Add(time.Duration(secs) * time.Second)
+			}
+		}
+		subpackets = subpackets[n+length:]
+	}
+}
+
+// parsePGPKey parses a version 4 public or secret key packet body.
+func parsePGPKey(body []byte, secret bool) (*pgpKey, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, fmt.Errorf("unsupported key packet version")
+	}
+	key := &pgpKey{
+		created: time.Unix(int64(binary.BigEndian.Uint32(body[1:5])), 0),
+		algo:    body[5],
+	}
+	data := body[6:]
+	var err error
+	switch key.algo {
+	case pgpAlgoRSA, pgpAlgoRSAEncrypt, pgpAlgoRSASign:
+		var n, e []byte
+		if n, data, err = readMPI(data); err != nil {
+			return nil, err
+		}
+		if e, data, err = readMPI(data); err != nil {
+			return nil, err
+		}
+		key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case pgpAlgoEdDSA, pgpAlgoECDH:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, fmt.Errorf("truncated key packet")
+		}
+		key.oid, data = data[1:1+int(data[0])], data[1+int(data[0]):]
+		if key.point, data, err = readMPI(data); err != nil {
+			return nil, err
+		}
+		if key.algo == pgpAlgoECDH {
+			if len(data) < 4 || data[0] != 3 {
+				return nil, fmt.Errorf("invalid ECDH KDF parameters")
+			}
+			key.kdfHash, key.kdfCipher = data[2], data[3]
+			data = data[4:]
+		} else if !bytes.Equal(key.oid, pgpOIDEd25519) {
+			return nil, fmt.Errorf("unsupported EdDSA curve")
+		}
+	default:
+		// Keep unsupported keys so that fingerprints and structure stay
+		// intact; they are skipped when choosing a key.
+		data = nil
+	}
+
+	key.body = body[:len(body)-len(data)]
+	if secret {
+		key.secret = data
+	}
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(key.body) >> 8), byte(len(key.body))})
+	h.Write(key.body)
+	key.fingerprint = h.Sum(nil)
+	key.keyID = key.fingerprint[12:]
+	return key, nil
+}
+
+// readPGPPacket reads one old or new format packet from data.
+func readPGPPacket(data []byte) (tag byte, body, rest []byte, err error) {
+	if len(data) < 2 || data[0]&0x80 == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid OpenPGP packet")
+	}
+	var length, offset int
+	if data[0]&0x40 != 0 {
+		tag = data[0] & 0x3f
+		switch o := data[1]; {
+		case o < 192:
+			length, offset = int(o), 2
+		case o < 224:
+			if len(data) < 3 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = (int(o)-192)<<8+int(data[2])+192, 3
+		case o == 255:
+			if len(data) < 6 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = int(binary.BigEndian.Uint32(data[2:6])), 6
+		default:
+			return 0, nil, nil, fmt.Errorf("partial body lengths are not supported in key files")
+		}
+	} else {
+		tag = (data[0] >> 2) & 0x0f
+		switch data[0] & 3 {
+		case 0:
+			length, offset = int(data[1]), 2
+		case 1:
+			if len(data) < 3 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = int(binary.BigEndian.Uint16(data[1:3])), 3
+		case 2:
+			if len(data) < 5 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = int(binary.BigEndian.Uint32(data[1:5])), 5
+		default:
+			length, offset = len(data)-1, 1
+		}
+	}
+	if len(data) < offset+length {
+		return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+// pgpPacket encodes a new format packet.
+func pgpPacket(tag byte, body []byte) []byte {
+	out := []byte{0xc0 | tag}
+	switch n := len(body); {
+	case n < 192:
+		out = append(out, byte(n))
+	case n < 8384:
+		n -= 192
+		out = append(out, byte(n>>8)+192, byte(n))
+	default:
+		out = append(out, 255)
+		out = binary.BigEndian.AppendUint32(out, uint32(n))
+	}
+	return append(out, body...)
+}
+
+func pgpSubpacket(typ byte, value []byte) []byte {
+	return append([]byte{byte(len(value) + 1), typ}, value...)
+}
+
+func pgpSubpacketLength(data []byte) (length, n int) {
+	switch o := data[0]; {
+	case o < 192:
+		return int(o), 1
+	case o < 255:
+		if len(data) < 2 {
+			return 0, 0
+		}
+		return (int(o)-192)<<8 + int(data[1]) + 192, 2
+	default:
+		if len(data) < 5 {
+			return 0, 0
+		}
+		return int(binary.BigEndian.Uint32(data[1:5])), 5
+	}
+}
+
+// pgpMPI encodes b as a multiprecision integer.
+func pgpMPI(b []byte) []byte {
+	b = bytes.TrimLeft(b, "\x00")
+	bits := 0
+	if len(b) > 0 {
+		bits = (len(b)-1)*8 + new(big.Int).SetBytes(b[:1]).BitLen()
+	}
+	return append([]byte{byte(bits >> 8), byte(bits)}, b...)
+}
+
+func readMPI(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("truncated MPI")
+	}
+	n := (int(binary.BigEndian.Uint16(data)) + 7) / 8
+	if len(data) < 2+n {
+		return nil, nil, fmt.Errorf("truncated MPI")
+	}
+	return data[2 : 2+n], data[2+n:], nil
+}
+
+// pgpArmor returns data in ASCII armor with the given block type.
+func pgpArmor(blockType string, data []byte) string {
+	var b strings.Builder
+	b.WriteString("-----BEGIN " + blockType + "-----\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for i := 0; i < len(encoded); i += 64 {
+		b.WriteString(encoded[i:min(i+64, len(encoded))] + "\r\n")
+	}
+	crc := crc24(data)
+	b.WriteString("=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\r\n")
+	b.WriteString("-----END " + blockType + "-----\r\n")
+	return b.String()
+}
+
+// pgpDearmor decodes every armored block in text.
+func pgpDearmor(text string) ([][]byte, error) {
+	var blocks [][]byte
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "-----BEGIN PGP") {
+			continue
+		}
+		// Skip armor headers up to the first blank line
+		for i++; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+			if !strings.Contains(lines[i], ":") {
+				break
+			}
+		}
+		var encoded strings.Builder
+		for ; i < len(lines) && !strings.HasPrefix(lines[i], "-----END PGP"); i++ {
+			line := strings.TrimSpace(lines[i])
+			if strings.HasPrefix(line, "=") {
+				continue
+			}
+			encoded.WriteString(line)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid armor: %w", err)
+		}
+		blocks = append(blocks, data)
+	}
+	return blocks, nil
+}
+
+func crc24(data []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Retry schedule for temporarily failed deliveries: the delay starts at
+// queueRetryMin and doubles with every attempt up to queueRetryMax.
+const (
+	queueRetryMin = 5 * time.Minute
+	queueRetryMax = 4 * time.Hour
+)
+
+// queueEntry is the envelope and delivery state of a spooled message. It is
+// stored as <id>.json next to the message in <id>.eml.
+type queueEntry struct {
+	ID          string    `json:"-"`
+	From        string    `json:"from"`
+	Rcpts       []string  `json:"rcpts"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// queueSpool is an outbound queue directory.
+type queueSpool struct {
+	dir    string
+	config *Config
+}
+
+func defaultQueueDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "smtp-cli-queue"
+	}
+	return filepath.Join(home, ".smtp-cli", "queue")
+}
+
+// runQueue implements "smtp-cli queue add|run|flush|list|delete". All
+// actions accept the regular options; add uses the message options, run and
+// flush the connection options.
+func runQueue(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(os.Stderr, "Usage: %s queue add|run|flush|list|delete [options] [id...]\n", os.Args[0])
+		return 2
+	}
+	action := args[0]
+	config := parseFlags(args[1:])
+	q := &queueSpool{dir: config.QueueDir, config: config}
+
+	var err error
+	switch action {
+	case "add":
+		err = q.add()
+	case "run":
+		err = q.run(false)
+	case "flush":
+		err = q.run(true)
+	case "list":
+		err = q.list()
+	case "delete":
+		err = q.delete(flag.Args())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown queue action %q\n", action)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "queue %s: %v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+// add composes the message(s) described by the options and spools them.
+func (q *queueSpool) add() error {
+	if err := validateAddresses(q.config); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return err
+	}
+
+	files := []string{""}
+	if len(q.config.DataFiles) > 0 {
+		var err error
+		if files, err = expandDataFiles(q.config.DataFiles); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		c := *q.config
+		c.Data = file
+		msg, err := buildMessage(&c)
+		if err != nil {
+			return err
+		}
+		if len(msg.rcpts) == 0 {
+			return fmt.Errorf("no recipients")
+		}
+		e := &queueEntry{
+			ID:      newQueueID(),
+			From:    msg.from,
+			Rcpts:   msg.rcpts,
+			Created: time.Now().UTC(),
+		}
+		e.NextAttempt = e.Created
+		if err := writeFileAtomic(q.path(e.ID, ".eml"), []byte(normalizeCRLF(msg.data))); err != nil {
+			return err
+		}
+		if err := q.save(e); err != nil {
+			return err
+		}
+		fmt.Println(e.ID)
+	}
+	return nil
+}
+
+// run attempts delivery of every entry that is due, or of all entries when
+// force is set. Accepted recipients are removed from an entry, permanently
+// rejected ones are written to the bounce log and the rest are retried
+// later with exponential backoff until the entry expires. With
+// --queue-interval, run keeps the lock and checks the queue again every
+// interval instead of returning.
+func (q *queueSpool) run(force bool) error {
+	if q.config.Server == "" {
+		return fmt.Errorf("--server is required")
+	}
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for {
+		if err := q.deliver(force); err != nil {
+			return err
+		}
+		if force || q.config.QueueInterval <= 0 {
+			return nil
+		}
+		time.Sleep(time.Duration(q.config.QueueInterval) * time.Minute)
+	}
+}
+
+// deliver makes one pass over the queue for run.
+func (q *queueSpool) deliver(force bool) error {
+	entries, err := q.entries()
+	if err != nil {
+		return err
+	}
+
+	var client *SMTPClient
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	now := time.Now().UTC()
+	var delivered, deferred, bounced int
+	var connectErr error
+	for _, e := range entries {
+		if !force && e.NextAttempt.After(now) {
+			continue
+		}
+		data, err := os.ReadFile(q.path(e.ID, ".eml"))
+		if err != nil {
+			return err
+		}
+
+		var retry []string
+		var failures map[string]error
+		var lastErr error
+		if client == nil && connectErr == nil {
+			client, connectErr = openSession(q.config)
+		}
+		if connectErr != nil {
+			// Don't try to reconnect for every entry while the server is
+			// unreachable
+			retry, lastErr = e.Rcpts, connectErr
+		} else {
+			retry, failures, lastErr = q.attempt(client, e, string(data))
+			if lastErr != nil && !isProtocolError(lastErr) {
+				client.conn.Close()
+				client = nil
+			}
+		}
+
+		for rcpt, err := range failures {
+			q.bounce(e, rcpt, err)
+			bounced++
+		}
+		if len(retry) == 0 {
+			if len(failures) == 0 {
+				delivered++
+			}
+			if err := q.remove(e.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		e.Rcpts = retry
+		e.Attempts++
+		e.LastError = lastErr.Error()
+		if now.Sub(e.Created) > time.Duration(q.config.QueueExpireDays)*24*time.Hour {
+			for _, rcpt := range retry {
+				q.bounce(e, rcpt, fmt.Errorf("expired after %d days: %w", q.config.QueueExpireDays, lastErr))
+				bounced++
+			}
+			if err := q.remove(e.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		e.NextAttempt = now.Add(queueBackoff(e.Attempts))
+		if err := q.save(e); err != nil {
+			return err
+		}
+		deferred++
+		if q.config.Verbose > 0 {
+			fmt.Printf("%s: deferred until %s: %v\n", e.ID, e.NextAttempt.Local().Format(time.DateTime), lastErr)
+		}
+	}
+
+	if q.config.Verbose > 0 || deferred > 0 || bounced > 0 {
+		fmt.Printf("%d delivered, %d deferred, %d recipient(s) bounced\n", delivered, deferred, bounced)
+	}
+	return nil
+}
+
+// attempt runs one transaction for e, handling each recipient on its own.
+// It returns the recipients to retry, the permanently failed recipients and
+// the last error seen.
+func (q *queueSpool) attempt(c *SMTPClient, e *queueEntry, data string) ([]string, map[string]error, error) {
+	failures := make(map[string]error)
+	if err := c.MailFrom(e.From); err != nil {
+		err = fmt.Errorf("MAIL FROM failed: %w", err)
+		if isPermanent(err) {
+			for _, rcpt := range e.Rcpts {
+				failures[rcpt] = err
+			}
+			c.Reset()
+			return nil, failures, err
+		}
+		if isProtocolError(err) {
+			c.Reset()
+		}
+		return e.Rcpts, failures, err
+	}
+
+	var accepted, retry []string
+	var lastErr error
+	for i, rcpt := range e.Rcpts {
+		err := c.RcptTo(rcpt)
+		switch {
+		case err == nil:
+			accepted = append(accepted, rcpt)
+			continue
+		case isPermanent(err):
+			failures[rcpt] = fmt.Errorf("RCPT TO failed: %w", err)
+		case isProtocolError(err):
+			retry = append(retry, rcpt)
+			lastErr = fmt.Errorf("RCPT TO %s failed: %w", rcpt, err)
+		default:
+			// Connection lost, everything not yet delivered is retried
+			return append(append(retry, accepted...), e.Rcpts[i:]...), failures, err
+		}
+	}
+	if len(accepted) == 0 {
+		c.Reset()
+		return retry, failures, lastErr
+	}
+
+	if err := c.Data(data); err != nil {
+		err = fmt.Errorf("DATA failed: %w", err)
+		if isPermanent(err) {
+			for _, rcpt := range accepted {
+				failures[rcpt] = err
+			}
+		} else {
+			retry = append(retry, accepted...)
+		}
+		if isProtocolError(err) {
+			c.Reset()
+		}
+		return retry, failures, err
+	}
+	return retry, failures, lastErr
+}
+
+// list prints the queued messages.
+func (q *queueSpool) list() error {
+	entries, err := q.entries()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Queue is empty")
+		return nil
+	}
+	for _, e := range entries {
+		size := int64(0)
+		if info, err := os.Stat(q.path(e.ID, ".eml")); err == nil {
+			size = info.Size()
+		}
+		fmt.Printf("%s  %8d  %s  attempts=%d next=%s\n", e.ID, size,
+			e.Created.Local().Format(time.DateTime), e.Attempts, e.NextAttempt.Local().Format(time.DateTime))
+		fmt.Printf("    from: <%s>\n    to:   %s\n", e.From, strings.Join(e.Rcpts, ", "))
+		if e.LastError != "" {
+			fmt.Printf("    last error: %s\n", e.LastError)
+		}
+	}
+	fmt.Printf("%d message(s) queued\n", len(entries))
+	return nil
+}
+
+// delete removes the given entries from the queue.
+func (q *queueSpool) delete(ids []string) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("no queue IDs given")
+	}
+	for _, id := range ids {
+		if filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+			return fmt.Errorf("invalid queue ID %q", id)
+		}
+		if _, err := os.Stat(q.path(id, ".json")); err != nil {
+			return fmt.Errorf("no such queue entry %q", id)
+		}
+		if err := q.remove(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries loads all queue entries, oldest first.
+func (q *queueSpool) entries() ([]*queueEntry, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*queueEntry
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		e := &queueEntry{ID: strings.TrimSuffix(filepath.Base(file), ".json")}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// save writes the entry's metadata. The message file must already exist:
+// entries without a .json file are ignored, so it is written last.
+func (q *queueSpool) save(e *queueEntry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path(e.ID, ".json"), append(data, '\n'))
+}
+
+func (q *queueSpool) remove(id string) error {
+	if err := os.Remove(q.path(id, ".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(q.path(id, ".eml")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (q *queueSpool) path(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+// bounce records a permanently failed recipient in <queue-dir>/bounces.log.
+func (q *queueSpool) bounce(e *queueEntry, rcpt string, reason error) {
+	line := fmt.Sprintf("%s id=%s from=<%s> to=<%s> error=%q\n",
+		time.Now().UTC().Format(time.RFC3339), e.ID, e.From, rcpt, reason.Error())
+	f, err := os.OpenFile(filepath.Join(q.dir, "bounces.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = f.WriteString(line)
+		f.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write bounce log: %v\n", err)
+	}
+	fmt.Fprint(os.Stderr, "bounced: "+line)
+}
+
+// lock prevents concurrent runs from delivering the same entries twice. The
+// lock file holds the PID of the run; a lock left behind by a run that was
+// killed is reclaimed. The lock is written to a temporary file first and
+// linked or renamed into place, so it never exists without a PID, and a
+// takeover counts only if the lock holds our PID afterwards.
+func (q *queueSpool) lock() (func(), error) {
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(q.dir, ".lock")
+	pid := strconv.Itoa(os.Getpid())
+	tmp := name + "." + pid
+	if err := os.WriteFile(tmp, []byte(pid+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(tmp, name); err != nil {
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if !staleLock(name) {
+			return nil, fmt.Errorf("queue is locked by another run (remove %s if it is stale)", name)
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			return nil, err
+		}
+		// Another run reclaiming the same stale lock may have renamed its
+		// own file over ours
+		if lockOwner(name) != pid {
+			return nil, fmt.Errorf("queue is locked by another run (remove %s if it is stale)", name)
+		}
+	}
+	return func() {
+		if lockOwner(name) == pid {
+			os.Remove(name)
+		}
+	}, nil
+}
+
+// lockOwner returns the PID stored in the lock file, or "" if it can't be
+// read.
+func lockOwner(name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// staleLock reports whether the process that created the lock file is gone.
+// A lock file without a PID is stale once it is a minute old.
+func staleLock(name string) bool {
+	pid, err := strconv.Atoi(lockOwner(name))
+	if err != nil || pid <= 0 {
+		info, err := os.Stat(name)
+		return err == nil && time.Since(info.ModTime()) > time.Minute
+	}
+	return !processExists(pid)
+}
+
+// processExists reports whether a process with the given PID is running.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess fails there if the process does not exist
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// queueBackoff returns the delay before the next attempt.
+func queueBackoff(attempts int) time.Duration {
+	d := queueRetryMin
+	for i := 1; i < attempts && d < queueRetryMax; i++ {
+		d *= 2
+	}
+	return min(d, queueRetryMax)
+}
+
+// isProtocolError reports whether err is an SMTP reply from the server, as
+// opposed to a network error.
+func isProtocolError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr)
+}
+
+// isPermanent reports whether err is a 5xx SMTP reply.
+func isPermanent(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
+
+func newQueueID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into
+// place so that readers never see a partial file.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
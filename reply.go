@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// applyReply fills in the reply to the --reply message: the subject gets a
+// "Re:" prefix, the original Message-ID is added to In-Reply-To and
+// References (RFC 5322 section 3.6.4), and the reply goes to the original's
+// Reply-To or, failing that, its From. Values given on the command line take
+// precedence.
+func applyReply(config *Config) error {
+	_, header, err := readMessageFile(config.Reply)
+	if err != nil {
+		return err
+	}
+
+	if config.Subject == "" {
+		subject := decodeHeaderText(header.Get("Subject"))
+		if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+			subject = strings.TrimSpace("Re: " + subject)
+		}
+		config.Subject = subject
+	}
+
+	if len(config.To) == 0 {
+		for _, name := range []string{"Reply-To", "From"} {
+			if value := header.Get(name); value != "" {
+				if err := appendAddresses(&config.To, value); err != nil {
+					return fmt.Errorf("invalid %s header in %s: %w", name, config.Reply, err)
+				}
+				break
+			}
+		}
+		if len(config.To) == 0 {
+			return fmt.Errorf("%s has no Reply-To or From header to reply to", config.Reply)
+		}
+	}
+
+	ids := parentMsgIDs(config, "Message-ID", header.Get("Message-ID"))
+	if len(ids) == 0 {
+		return nil
+	}
+	id := ids[0]
+	if config.InReplyTo == "" {
+		config.InReplyTo = id
+	}
+	if len(config.References) == 0 {
+		// Without References, the parent's In-Reply-To holds its parent
+		name := "References"
+		if header.Get(name) == "" {
+			name = "In-Reply-To"
+		}
+		config.References = append(parentMsgIDs(config, name, header.Get(name)), id)
+	}
+	return nil
+}
+
+// parentMsgIDs returns the valid message identifiers in a header of the
+// message being replied to. Malformed ones are common in the wild and are
+// skipped, so that they do not prevent the reply, with a warning under
+// --verbose.
+func parentMsgIDs(config *Config, name, value string) []string {
+	var ids []string
+	for _, id := range splitMsgIDs(value) {
+		if !isMsgID(id) {
+			if config.Verbose > 0 {
+				fmt.Fprintf(os.Stderr, "warning: skipping invalid message ID %q in %s header of %s\n", id, name, config.Reply)
+			}
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// splitMsgIDs splits a list of message identifiers, given with or without
+// angle brackets and separated by whitespace or commas.
+func splitMsgIDs(value string) []string {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || isWSP(r) || r == '\r' || r == '\n'
+	})
+	for i, id := range fields {
+		fields[i] = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	}
+	return fields
+}
+
+// formatMsgIDs parses the message identifiers in values, as split by
+// splitMsgIDs, and formats them for an In-Reply-To or References header,
+// folding long lists.
+func formatMsgIDs(name string, values []string) (string, error) {
+	var ids []string
+	for _, value := range values {
+		for _, id := range splitMsgIDs(value) {
+			if !isMsgID(id) {
+				return "", fmt.Errorf("invalid %s message ID %q", name, id)
+			}
+			ids = append(ids, "<"+id+">")
+		}
+	}
+
+	var b strings.Builder
+	lineLen := len(name) + 1
+	for i, id := range ids {
+		if i > 0 && lineLen+1+len(id) > 78 {
+			b.WriteString("\r\n")
+			lineLen = 0
+		}
+		b.WriteString(" " + id)
+		lineLen += 1 + len(id)
+	}
+	return strings.TrimPrefix(b.String(), " "), nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// Exit codes from sysexits.h, which sendmail callers such as cron and PHP
+// interpret.
+const (
+	exUsage       = 64
+	exDataErr     = 65
+	exNoInput     = 66
+	exUnavailable = 69
+	exSoftware    = 70
+	exTempFail    = 75
+	exConfig      = 78
+)
+
+// sendmailConfigFile holds the smtp-cli options (server, credentials, DKIM
+// key, ...) used in sendmail mode, one long option per line. The
+// SMTP_CLI_CONFIG environment variable overrides the location.
+const sendmailConfigFile = "/etc/smtp-cli.conf"
+
+// sendmailOptions are the classic sendmail command line options.
+type sendmailOptions struct {
+	readHeaders bool   // -t
+	ignoreDots  bool   // -i, -oi
+	sender      string // -f
+	fullName    string // -F
+	verbose     bool   // -v
+	rcpts       []string
+}
+
+// runSendmail implements the sendmail command line interface: the message
+// is read from standard input and delivered to the recipients given as
+// arguments and, with -t, to those in its To, Cc and Bcc headers.
+func runSendmail(args []string) int {
+	opts, longArgs, err := parseSendmailArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exUsage
+	}
+
+	confArgs, err := readSendmailConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exConfig
+	}
+	config := parseFlags(append(confArgs, longArgs...))
+	if opts.verbose && config.Verbose == 0 {
+		config.Verbose = 1
+	}
+	if config.Server == "" && !config.PrintOnly {
+		fmt.Fprintf(os.Stderr, "sendmail: no server configured, set --server in %s\n", sendmailConfigPath())
+		return exConfig
+	}
+
+	data, err := readSendmailInput(os.Stdin, opts.ignoreDots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: failed to read message: %v\n", err)
+		return exNoInput
+	}
+
+	msg, err := prepareSendmailMessage(config, opts, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		if errors.Is(err, errInvalidHeader) {
+			return exDataErr
+		}
+		return exUsage
+	}
+	if msg.data, err = secureMessage(config, msg.data); err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exSoftware
+	}
+
+	if config.PrintOnly {
+		fmt.Print(msg.data)
+		return 0
+	}
+
+	client, err := openSession(config)
+	if err == nil {
+		err = client.Send(msg)
+		client.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		if isPermanent(err) {
+			return exUnavailable
+		}
+		return exTempFail
+	}
+	return 0
+}
+
+// parseSendmailArgs parses sendmail's single-dash options, which may have
+// their value attached ("-fuser@example.com") or as the next argument.
+// Long "--option=value" arguments are returned separately so that smtp-cli
+// options can be given after --sendmail. Options that only affect a real
+// MTA's queueing or error reporting are accepted and ignored.
+func parseSendmailArgs(args []string) (*sendmailOptions, []string, error) {
+	opts := &sendmailOptions{}
+	var longArgs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			opts.rcpts = append(opts.rcpts, args[i+1:]...)
+			return opts, longArgs, nil
+		case strings.HasPrefix(arg, "--"):
+			longArgs = append(longArgs, arg)
+			continue
+		case !strings.HasPrefix(arg, "-") || arg == "-":
+			opts.rcpts = append(opts.rcpts, arg)
+			continue
+		}
+
+		// value returns the option argument, attached or separate
+		value := func() (string, error) {
+			if len(arg) > 2 {
+				return arg[2:], nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("option %s requires an argument", arg)
+			}
+			i++
+			return args[i], nil
+		}
+
+		var err error
+		switch arg[1] {
+		case 't':
+			opts.readHeaders = true
+		case 'i':
+			opts.ignoreDots = true
+		case 'v':
+			opts.verbose = true
+		case 'f', 'r':
+			opts.sender, err = value()
+		case 'F':
+			opts.fullName, err = value()
+		case 'o':
+			// -oi is the same as -i; other -o options (-odb, -oem, ...) only
+			// matter to a real MTA
+			if arg == "-oi" {
+				opts.ignoreDots = true
+			}
+		case 'b':
+			if arg != "-bm" {
+				return nil, nil, fmt.Errorf("mode %s is not supported", arg)
+			}
+		case 'B', 'N', 'R', 'V', 'L', 'X', 'h', 'C':
+			_, err = value()
+		case 'G', 'U', 'm', 'n', 'e', 'd', 'A':
+			// accepted for compatibility
+		default:
+			return nil, nil, fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return opts, longArgs, nil
+}
+
+func sendmailConfigPath() string {
+	if path := os.Getenv("SMTP_CLI_CONFIG"); path != "" {
+		return path
+	}
+	return sendmailConfigFile
+}
+
+// readSendmailConfig returns the options in the sendmail mode config file.
+// Blank lines and lines starting with "#" are skipped and the leading "--"
+// of each option is optional. A missing file is not an error.
+func readSendmailConfig() ([]string, error) {
+	data, err := os.ReadFile(sendmailConfigPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, "--"+strings.TrimLeft(line, "-"))
+	}
+	return args, nil
+}
+
+// readSendmailInput reads the message from r. Unless ignoreDots is set, a
+// line consisting of a single dot ends the message, as in classic sendmail.
+func readSendmailInput(r io.Reader, ignoreDots bool) (string, error) {
+	if ignoreDots {
+		data, err := io.ReadAll(r)
+		return string(data), err
+	}
+	var b strings.Builder
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+		b.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// prepareSendmailMessage determines the envelope of a message submitted in
+// sendmail mode and adds the From, Date and Message-ID headers if they are
+// missing. The Bcc header is always removed.
+// errInvalidHeader marks a message whose header can't be parsed, as opposed
+// to bad options.
+var errInvalidHeader = errors.New("invalid message header")
+
+func prepareSendmailMessage(config *Config, opts *sendmailOptions, data string) (*outgoingMessage, error) {
+	data = normalizeCRLF(data)
+	m, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidHeader, err)
+	}
+
+	msg := &outgoingMessage{}
+	for _, rcpt := range opts.rcpts {
+		if err := appendEnvelopeAddresses(&msg.rcpts, rcpt); err != nil {
+			return nil, err
+		}
+	}
+	if opts.readHeaders {
+		rcpts, err := headerAddresses(m.Header, "To", "Cc", "Bcc")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidHeader, err)
+		}
+		msg.rcpts = append(msg.rcpts, rcpts...)
+	}
+	if len(config.RcptTo) > 0 {
+		msg.rcpts = config.RcptTo
+	}
+	if len(msg.rcpts) == 0 {
+		return nil, fmt.Errorf("no recipients given")
+	}
+
+	// Envelope sender: -f, --mail-from, the From header or the local user
+	switch {
+	case opts.sender == "<>":
+	case opts.sender != "":
+		addr, err := mail.ParseAddress(opts.sender)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sender %q: %w", opts.sender, err)
+		}
+		msg.from = addr.Address
+	case config.MailFrom != "":
+		msg.from = config.MailFrom
+	default:
+		if from, err := headerAddresses(m.Header, "From"); err == nil && len(from) > 0 {
+			msg.from = from[0]
+		} else {
+			msg.from = localUser() + "@" + getHostname()
+		}
+	}
+
+	var extra strings.Builder
+	if m.Header.Get("From") == "" {
+		addr := &mail.Address{Name: opts.fullName, Address: msg.from}
+		if addr.Address == "" {
+			addr.Address = localUser() + "@" + getHostname()
+		}
+		extra.WriteString("From: " + formatAddress(addr) + "\r\n")
+	}
+	if m.Header.Get("Date") == "" {
+		extra.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	}
+	if m.Header.Get("Message-ID") == "" {
+		extra.WriteString("Message-ID: " + newMessageID() + "\r\n")
+	}
+
+	msg.data = extra.String() + removeHeaderFields(data, func(name string) bool {
+		return strings.EqualFold(name, "Bcc")
+	})
+	return msg, nil
+}
+
+// appendEnvelopeAddresses parses an address list and appends the bare
+// addresses to list.
+func appendEnvelopeAddresses(list *[]string, s string) error {
+	addrs, err := mail.ParseAddressList(s)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	for _, addr := range addrs {
+		*list = append(*list, addr.Address)
+	}
+	return nil
+}
+
+// headerAddresses returns the bare addresses in the given address headers.
+// Every instance of a repeated header is used.
+func headerAddresses(header mail.Header, names ...string) ([]string, error) {
+	var addrs []string
+	for _, name := range names {
+		for _, value := range header[textproto.CanonicalMIMEHeaderKey(name)] {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			list, err := addressParser.ParseList(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s header %q: %w", name, value, err)
+			}
+			for _, addr := range list {
+				addrs = append(addrs, addr.Address)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// removeHeaderFields returns the CRLF message with the header fields for
+// which remove returns true deleted, including their continuation lines.
+func removeHeaderFields(message string, remove func(name string) bool) string {
+	header, body := splitMessage(message)
+	var b strings.Builder
+	for _, field := range parseHeaderFields(header) {
+		if !remove(field.name) {
+			b.WriteString(field.raw + "\r\n")
+		}
+	}
+	return b.String() + "\r\n" + body
+}
+
+// localUser returns the name of the user running smtp-cli.
+func localUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "nobody"
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	oidData                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256        = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAES256CBC              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// CMS structures from RFC 5652, limited to what is needed for detached
+// signatures and key transport enveloping.
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo contentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+// smimeWrap signs and/or encrypts the MIME entity of message according to
+// the --smime-* options. The content headers (Content-*) and body form the
+// entity that is protected; the remaining headers stay on the outer message.
+func smimeWrap(config *Config, message string) (string, error) {
+	outer, entity := splitMIMEEntity(message)
+
+	if config.SMIMESignCert != "" {
+		certs, err := loadCertificates(config.SMIMESignCert)
+		if err != nil {
+			return "", fmt.Errorf("failed to load S/MIME signing certificate: %w", err)
+		}
+		keyFile := config.SMIMESignKey
+		if keyFile == "" {
+			keyFile = config.SMIMESignCert
+		}
+		key, err := loadPrivateKey(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to load S/MIME signing key: %w", err)
+		}
+		// The CRLF before the next boundary is not part of the signed content
+		entity = strings.TrimSuffix(entity, "\r\n")
+		signature, err := smimeSign([]byte(entity), certs, key)
+		if err != nil {
+			return "", fmt.Errorf("S/MIME signing failed: %w", err)
+		}
+
+		boundary := "----=_Signed_" + uniqueID()
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\";\r\n micalg=sha-256; boundary=\"%s\"\r\n\r\n", boundary))
+		b.WriteString("This is a cryptographically signed message in MIME format.\r\n\r\n")
+		b.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		b.WriteString(entity + "\r\n")
+		b.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		b.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+		b.WriteString("Content-Transfer-Encoding: base64\r\n")
+		b.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+		b.WriteString(wrapBase64(signature))
+		b.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+		entity = b.String()
+	}
+
+	if len(config.SMIMEEncryptCert) > 0 {
+		var recipients []*x509.Certificate
+		for _, filename := range config.SMIMEEncryptCert {
+			certs, err := loadCertificates(filename)
+			if err != nil {
+				return "", fmt.Errorf("failed to load S/MIME recipient certificate: %w", err)
+			}
+			recipients = append(recipients, certs...)
+		}
+		enveloped, err := smimeEncrypt([]byte(entity), recipients)
+		if err != nil {
+			return "", fmt.Errorf("S/MIME encryption failed: %w", err)
+		}
+
+		var b strings.Builder
+		b.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data;\r\n name=\"smime.p7m\"\r\n")
+		b.WriteString("Content-Transfer-Encoding: base64\r\n")
+		b.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n\r\n")
+		b.WriteString(wrapBase64(enveloped))
+		entity = b.String()
+	}
+
+	return outer + entity, nil
+}
+
+// smimeSign returns a detached CMS SignedData over content. The first
+// certificate is the signer's; any others are included as the chain.
+func smimeSign(content []byte, certs []*x509.Certificate, key crypto.Signer) ([]byte, error) {
+	cert := certs[0]
+	digest := sha256.Sum256(content)
+
+	var sigAlg asn1.ObjectIdentifier
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		sigAlg = oidRSAEncryption
+	case *ecdsa.PrivateKey:
+		sigAlg = oidECDSAWithSHA256
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+
+	signingTime, err := asn1.Marshal(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	contentType, err := asn1.Marshal(oidData)
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := marshalSet([]attribute{
+		{Type: oidAttributeContentType, Values: asn1.RawValue{FullBytes: wrapSet(contentType)}},
+		{Type: oidAttributeSigningTime, Values: asn1.RawValue{FullBytes: wrapSet(signingTime)}},
+		{Type: oidAttributeMessageDigest, Values: asn1.RawValue{FullBytes: wrapSet(messageDigest)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the DER encoding of the attributes as a SET
+	attrsDigest := sha256.Sum256(attrs)
+	signature, err := key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	// In the SignerInfo the attributes are tagged [0] IMPLICIT
+	implicitAttrs := append([]byte{0xa0}, attrs[1:]...)
+
+	var rawCerts []byte
+	for _, c := range certs {
+		rawCerts = append(rawCerts, c.Raw...)
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: contentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: rawCerts},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{FullBytes: implicitAttrs},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg},
+			Signature:          signature,
+		}},
+	}
+	return marshalContentInfo(oidSignedData, sd)
+}
+
+// smimeEncrypt returns a CMS EnvelopedData of content encrypted with
+// AES-256-CBC for each RSA recipient certificate.
+func smimeEncrypt(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	plaintext := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	var infos []keyTransRecipientInfo
+	for _, cert := range recipients {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("recipient certificate %q: only RSA keys are supported", cert.Subject.CommonName)
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, keyTransRecipientInfo{
+			RID:                    issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		})
+	}
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	ed := envelopedData{
+		RecipientInfos: infos,
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+	}
+	return marshalContentInfo(oidEnvelopedData, ed)
+}
+
+func marshalContentInfo(contentType asn1.ObjectIdentifier, content any) ([]byte, error) {
+	inner, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: contentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// marshalSet DER encodes attrs as a SET OF, sorting the elements as DER
+// requires.
+func marshalSet(attrs []attribute) ([]byte, error) {
+	var elems [][]byte
+	for _, attr := range attrs {
+		der, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, der)
+	}
+	sort.Slice(elems, func(i, j int) bool { return bytes.Compare(elems[i], elems[j]) < 0 })
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(elems, nil)})
+}
+
+// wrapSet wraps a single DER element in a SET.
+func wrapSet(der []byte) []byte {
+	set, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der})
+	return set
+}
+
+// loadCertificates reads all PEM certificates from filename.
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", filename)
+	}
+	return certs, nil
+}
+
+// wrapBase64 base64 encodes data in lines of 76 characters.
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for i := 0; i < len(encoded); i += 76 {
+		b.WriteString(encoded[i:min(i+76, len(encoded))] + "\r\n")
+	}
+	return b.String()
+}
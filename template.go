@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// templateData builds the data that --subject and the --body-* options
+// templates are rendered against: the entries of --vars-file, overridden by
+// --var key=value pairs and the current --merge-file row, plus the
+// environment under .Env.
+func templateData(config *Config) (map[string]any, error) {
+	data := make(map[string]any)
+	if config.VarsFile != "" {
+		vars, err := loadVarsFile(config.VarsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load variables: %w", err)
+		}
+		for k, v := range vars {
+			data[k] = v
+		}
+	}
+	for _, v := range config.Vars {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid --var %q, expected key=value", v)
+		}
+		data[strings.TrimSpace(key)] = value
+	}
+	for k, v := range config.MergeRow {
+		data[k] = v
+	}
+
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			env[key] = value
+		}
+	}
+	if _, ok := data["Env"]; !ok {
+		data["Env"] = env
+	}
+	return data, nil
+}
+
+// renderTemplate executes text as a Go template. HTML bodies use
+// html/template so that variables are escaped for their context.
+func renderTemplate(name, text string, data map[string]any, html bool) (string, error) {
+	var b strings.Builder
+	if html {
+		t, err := htmltemplate.New(name).Option("missingkey=error").Funcs(htmltemplate.FuncMap{"env": os.Getenv}).Parse(text)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s template: %w", name, err)
+		}
+		if err := t.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("failed to render %s template: %w", name, err)
+		}
+		return b.String(), nil
+	}
+	t, err := texttemplate.New(name).Option("missingkey=error").Funcs(texttemplate.FuncMap{"env": os.Getenv}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+	return b.String(), nil
+}
+
+// usesTemplates reports whether message parts should be rendered as
+// templates.
+func usesTemplates(config *Config) bool {
+	return config.Template || len(config.Vars) > 0 || config.VarsFile != "" || config.MergeRow != nil
+}
+
+// loadVarsFile reads template variables from a JSON or YAML file. The
+// format is chosen by extension, defaulting to JSON if the content starts
+// with "{".
+func loadVarsFile(filename string) (map[string]any, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".json" || (ext != ".yaml" && ext != ".yml" && strings.HasPrefix(strings.TrimSpace(string(data)), "{")) {
+		var vars map[string]any
+		if err := json.Unmarshal(data, &vars); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		return vars, nil
+	}
+	value, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	vars, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: top level must be a mapping", filename)
+	}
+	return vars, nil
+}
+
+// yamlLine is a non-empty, comment-stripped line of a YAML document.
+type yamlLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+// parseYAML parses the block-style subset of YAML that is useful for
+// template variables: nested mappings, sequences and plain, single- or
+// double-quoted scalars. Flow collections, anchors and multi-line scalars
+// are not supported.
+func parseYAML(doc string) (any, error) {
+	var lines []yamlLine
+	for n, line := range strings.Split(strings.ReplaceAll(doc, "\r\n", "\n"), "\n") {
+		line = stripYAMLComment(line)
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.TrimSpace(trimmed) == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", n+1)
+		}
+		lines = append(lines, yamlLine{indent: len(line) - len(trimmed), text: strings.TrimRight(trimmed, " "), num: n + 1})
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	value, rest, err := parseYAMLBlock(lines, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("line %d: unexpected indentation", rest[0].num)
+	}
+	return value, nil
+}
+
+// parseYAMLBlock parses the mapping or sequence whose entries are indented
+// by indent and returns the lines following it.
+func parseYAMLBlock(lines []yamlLine, indent int) (any, []yamlLine, error) {
+	if strings.HasPrefix(lines[0].text, "- ") || lines[0].text == "-" {
+		var list []any
+		for len(lines) > 0 && lines[0].indent == indent && (strings.HasPrefix(lines[0].text, "- ") || lines[0].text == "-") {
+			item := strings.TrimSpace(strings.TrimPrefix(lines[0].text, "-"))
+			line := lines[0]
+			lines = lines[1:]
+			switch {
+			case item == "":
+				if len(lines) == 0 || lines[0].indent <= indent {
+					list = append(list, nil)
+					continue
+				}
+				value, rest, err := parseYAMLBlock(lines, lines[0].indent)
+				if err != nil {
+					return nil, nil, err
+				}
+				list, lines = append(list, value), rest
+			case isYAMLMappingEntry(item):
+				// "- key: value" starts a mapping indented past the dash
+				itemIndent := line.indent + len(line.text) - len(strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " "))
+				value, rest, err := parseYAMLBlock(append([]yamlLine{{indent: itemIndent, text: item, num: line.num}}, lines...), itemIndent)
+				if err != nil {
+					return nil, nil, err
+				}
+				list, lines = append(list, value), rest
+			default:
+				value, err := parseYAMLScalar(item, line.num)
+				if err != nil {
+					return nil, nil, err
+				}
+				list = append(list, value)
+			}
+		}
+		if len(lines) > 0 && lines[0].indent > indent {
+			return nil, nil, fmt.Errorf("line %d: unexpected indentation", lines[0].num)
+		}
+		return list, lines, nil
+	}
+
+	mapping := make(map[string]any)
+	for len(lines) > 0 && lines[0].indent == indent {
+		line := lines[0]
+		if !isYAMLMappingEntry(line.text) {
+			return nil, nil, fmt.Errorf("line %d: expected \"key: value\"", line.num)
+		}
+		key, value := splitYAMLMappingEntry(line.text)
+		lines = lines[1:]
+		if value == "" {
+			if len(lines) > 0 && (lines[0].indent > indent || lines[0].indent == indent && strings.HasPrefix(lines[0].text, "- ")) {
+				nested, rest, err := parseYAMLBlock(lines, lines[0].indent)
+				if err != nil {
+					return nil, nil, err
+				}
+				mapping[key], lines = nested, rest
+			} else {
+				mapping[key] = nil
+			}
+			continue
+		}
+		scalar, err := parseYAMLScalar(value, line.num)
+		if err != nil {
+			return nil, nil, err
+		}
+		mapping[key] = scalar
+	}
+	if len(lines) > 0 && lines[0].indent > indent {
+		return nil, nil, fmt.Errorf("line %d: unexpected indentation", lines[0].num)
+	}
+	return mapping, lines, nil
+}
+
+func isYAMLMappingEntry(text string) bool {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := strings.IndexByte(text[1:], text[0])
+		return end >= 0 && strings.HasPrefix(text[end+2:], ":")
+	}
+	i := strings.Index(text, ":")
+	return i > 0 && (i == len(text)-1 || text[i+1] == ' ')
+}
+
+func splitYAMLMappingEntry(text string) (string, string) {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := strings.IndexByte(text[1:], text[0]) + 1
+		return text[1:end], strings.TrimSpace(text[end+2:])
+	}
+	i := strings.Index(text, ":")
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+}
+
+func parseYAMLScalar(s string, num int) (any, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid double-quoted string", num)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: invalid single-quoted string", num)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") || strings.HasPrefix(s, "|") || strings.HasPrefix(s, ">"):
+		return nil, fmt.Errorf("line %d: flow collections and block scalars are not supported", num)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}
+
+// stripYAMLComment removes a "#" comment that is not inside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,91 @@
+#!/usr/bin/env python3
+"""Generate charset_tables.go, the legacy charset tables used by charset.go.
+
+The mappings are taken from Python's codecs so that smtp-cli has no
+dependencies outside the Go standard library. Run from the repository root:
+
+    python3 tools/gencharsets.py > charset_tables.go
+"""
+
+SINGLE_BYTE = [("ISO-8859-%d" % n, "iso8859_%d" % n) for n in range(1, 17) if n != 12] + \
+    [("windows-%d" % n, "cp%d" % n) for n in range(1250, 1259)]
+
+
+def high_half(codec):
+    table = []
+    for b in range(0x80, 0x100):
+        try:
+            table.append(ord(bytes([b]).decode(codec)))
+        except UnicodeDecodeError:
+            table.append(0)
+    return table
+
+
+def jis0208():
+    table = []
+    for row in range(1, 95):
+        for cell in range(1, 95):
+            code = bytes([0x1B, 0x24, 0x42, 0x20 + row, 0x20 + cell, 0x1B, 0x28, 0x42])
+            try:
+                s = code.decode("iso2022_jp")
+            except UnicodeDecodeError:
+                s = ""
+            table.append(ord(s) if len(s) == 1 else 0)
+    return table
+
+
+def sjis_bytes(row, cell):
+    """The Shift_JIS encoding of a JIS X 0208 row/cell code."""
+    lead = (row + 0x21) // 2 + (0x70 if row <= 62 else 0xB0)
+    if row % 2:
+        trail = cell + (0x3F if cell <= 63 else 0x40)
+    else:
+        trail = cell + 0x9E
+    return bytes([lead, trail])
+
+
+def check_sjis(table):
+    # The row/cell arithmetic in charset.go must agree with the shift_jis codec
+    for row in range(1, 95):
+        for cell in range(1, 95):
+            r = table[(row - 1) * 94 + cell - 1]
+            if r == 0:
+                continue
+            try:
+                s = sjis_bytes(row, cell).decode("shift_jis")
+            except UnicodeDecodeError:
+                continue
+            assert ord(s) == r, (row, cell, s, hex(r))
+
+
+def wrap(values, fmt, per_line):
+    lines = []
+    for i in range(0, len(values), per_line):
+        lines.append("\t" + ", ".join(fmt % v for v in values[i:i + per_line]) + ",")
+    return "\n".join(lines)
+
+
+def main():
+    print("// Code generated by tools/gencharsets.py from Python's codecs. DO NOT EDIT.")
+    print()
+    print("package main")
+    print()
+    print("// singleByteTables maps the bytes 0x80-0xFF of each single-byte charset")
+    print("// to Unicode. 0 marks an unassigned byte.")
+    print("var singleByteTables = map[string]*[128]rune{")
+    for name, codec in SINGLE_BYTE:
+        print('\t"%s": {' % name)
+        print(wrap(high_half(codec), "0x%04X", 8).replace("\n\t", "\n\t\t").replace("\t0x", "\t\t0x", 1))
+        print("\t},")
+    print("}")
+    print()
+    table = jis0208()
+    check_sjis(table)
+    print("// jis0208 maps JIS X 0208 codes, (row-1)*94 + (cell-1), to Unicode. 0 marks")
+    print("// an unassigned code.")
+    print("var jis0208 = [94 * 94]uint16{")
+    print(wrap(table, "0x%04X", 12))
+    print("}")
+
+
+main()